@@ -0,0 +1,606 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/yylt/rtspmux/config"
+	"github.com/yylt/rtspmux/stream"
+)
+
+type streamReq struct {
+	//Name is the id of stream, the crc32 of url when empty
+	Name string `json:"name,omitempty"`
+	Url string `json:"url"`
+	//Backups are switched to in order when the url is down
+	Backups []string `json:"backups,omitempty"`
+	//Record is the continuous recording of stream, empty is the global setting
+	Record *bool `json:"record,omitempty"`
+	hlsReq
+	sourceReq
+}
+
+//sourceReq is the dial setting of stream, empty field is the global setting
+type sourceReq struct {
+	DialTimeout string `json:"dial_timeout,omitempty"`
+	ReadTimeout string `json:"read_timeout,omitempty"`
+	KeepAlive string `json:"keepalive,omitempty"`
+	Failover string `json:"failover,omitempty"`
+	//OnDemand dial the source when requested by viewers
+	OnDemand *bool `json:"on_demand,omitempty"`
+	Idle string `json:"idle,omitempty"`
+}
+
+//hlsReq is the hls setting of stream, empty field is the global setting
+type hlsReq struct {
+	Segment string `json:"segment,omitempty"`
+	Duration string `json:"duration,omitempty"`
+	Length int `json:"length,omitempty"`
+	Retain int `json:"retain,omitempty"`
+}
+
+type streamResp struct {
+	Id string `json:"id"`
+	Url string `json:"url"`
+	Backups []string `json:"backups,omitempty"`
+	Segment string `json:"segment"`
+	Duration string `json:"duration,omitempty"`
+	Length int `json:"length,omitempty"`
+	Retain int `json:"retain,omitempty"`
+	DialTimeout string `json:"dial_timeout,omitempty"`
+	ReadTimeout string `json:"read_timeout,omitempty"`
+	KeepAlive string `json:"keepalive,omitempty"`
+	Failover string `json:"failover,omitempty"`
+	OnDemand bool `json:"on_demand"`
+	Idle string `json:"idle,omitempty"`
+	//Pulling is false when the on demand source is idle
+	Pulling bool `json:"pulling"`
+}
+
+//recordResp is the recording in catalog, end is empty when it is still written
+type recordResp struct {
+	Stream string `json:"stream"`
+	Name string `json:"name"`
+	Start time.Time `json:"start"`
+	End *time.Time `json:"end,omitempty"`
+	Size int64 `json:"size"`
+	Codec string `json:"codec,omitempty"`
+	Event string `json:"event,omitempty"`
+	Path string `json:"path"`
+	Url string `json:"url"`
+}
+
+//eventReq trigger a recording, empty field is the global setting
+type eventReq struct {
+	Name string `json:"name,omitempty"`
+	PreRoll string `json:"preroll,omitempty"`
+	PostRoll string `json:"postroll,omitempty"`
+}
+
+type eventResp struct {
+	Stream string `json:"stream"`
+	Name string `json:"name,omitempty"`
+	At time.Time `json:"at"`
+	Until time.Time `json:"until"`
+	PreRoll string `json:"preroll"`
+}
+
+//statsResp is the health of stream source, duration is in seconds
+type statsResp struct {
+	Id string `json:"id"`
+	Url string `json:"url"`
+	//Source is the url connected, it is a backup after fail over
+	Source string `json:"source"`
+	Connected bool `json:"connected"`
+	Uptime float64 `json:"uptime"`
+	Reconnects int `json:"reconnects"`
+	LastError string `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+	LastPacketAt *time.Time `json:"last_packet_at,omitempty"`
+	Bytes int64 `json:"bytes"`
+	Bitrate int64 `json:"bitrate"`
+	Video *videoStats `json:"video,omitempty"`
+	Audio *audioStats `json:"audio,omitempty"`
+}
+
+type videoStats struct {
+	Codec string `json:"codec"`
+	Width int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+	Fps float64 `json:"fps"`
+	Gop int `json:"gop"`
+	GopDuration float64 `json:"gop_duration"`
+}
+
+type audioStats struct {
+	Codec string `json:"codec"`
+	SampleRate int `json:"sample_rate,omitempty"`
+	Channels int `json:"channels,omitempty"`
+}
+
+//tokenReq mint playback token, ttl is the global setting when empty,
+//ip bind the token to client
+type tokenReq struct {
+	Ttl string `json:"ttl,omitempty"`
+	Ip string `json:"ip,omitempty"`
+}
+
+type tokenResp struct {
+	Stream string `json:"stream"`
+	Token string `json:"token"`
+	Expire time.Time `json:"expire"`
+	Url string `json:"url"`
+}
+
+type errResp struct {
+	Error string `json:"error"`
+}
+
+func (s *Server) apiRoute(r *mux.Router) {
+	r.Use(s.apiAuth)
+	r.HandleFunc("/streams",s.listStreams).Methods(http.MethodGet)
+	r.HandleFunc("/streams",s.createStream).Methods(http.MethodPost)
+	r.HandleFunc("/streams/{id}",s.getStream).Methods(http.MethodGet)
+	r.HandleFunc("/streams/{id}",s.deleteStream).Methods(http.MethodDelete)
+	r.HandleFunc("/streams/{id}/stats",s.getStats).Methods(http.MethodGet)
+	r.HandleFunc("/streams/{id}/tokens",s.createToken).Methods(http.MethodPost)
+	r.HandleFunc("/streams/{id}/recordings",s.listRecords).Methods(http.MethodGet)
+	r.HandleFunc("/streams/{id}/events",s.createEvent).Methods(http.MethodPost)
+	r.HandleFunc("/recordings",s.listRecords).Methods(http.MethodGet)
+}
+
+//apiAuth require the bearer key of api when it is set
+func (s *Server) apiAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter,req *http.Request) {
+		key := s.config().Api.Key
+		if key==""{
+			next.ServeHTTP(w,req)
+			return
+		}
+		auth := req.Header.Get("Authorization")
+		if !strings.HasPrefix(auth,"Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth,"Bearer ")),[]byte(key))!=1{
+			w.Header().Set("WWW-Authenticate","Bearer")
+			writeErr(w,http.StatusUnauthorized,fmt.Errorf("api key is required"))
+			return
+		}
+		next.ServeHTTP(w,req)
+	})
+}
+
+func writeJson(w http.ResponseWriter,code int,v interface{}) {
+	w.Header().Set("Content-Type","application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeErr(w http.ResponseWriter,code int,err error) {
+	writeJson(w,code,&errResp{Error:err.Error()})
+}
+
+func toResp(stm *stream.Stream) *streamResp {
+	hc := stm.HlsConf()
+	resp := &streamResp{
+		Id:stm.Id(),
+		Url:stm.Path(),
+		Backups:stm.Backups(),
+		Segment:hc.Segment.String(),
+		Length:hc.Length,
+		Retain:hc.Retain,
+	}
+	if hc.Duration>0{
+		resp.Duration = hc.Duration.String()
+	}
+	sc := stm.SourceConf()
+	if sc.DialTimeout>0{
+		resp.DialTimeout = sc.DialTimeout.String()
+	}
+	if sc.ReadTimeout>0{
+		resp.ReadTimeout = sc.ReadTimeout.String()
+	}
+	if sc.KeepAlive>0{
+		resp.KeepAlive = sc.KeepAlive.String()
+	}
+	if len(resp.Backups)>0{
+		resp.Failover = sc.Failover.String()
+	}
+	resp.OnDemand = sc.OnDemand
+	if sc.OnDemand{
+		resp.Idle = sc.Idle.String()
+	}
+	resp.Pulling = stm.Pulling()
+	return resp
+}
+
+//toReq convert the stream of config to request
+func toReq(st *config.StreamConfig) *streamReq {
+	return &streamReq{
+		Name:st.Name,
+		Url:st.Url,
+		Backups:st.Backups,
+		Record:st.Record,
+		hlsReq:hlsReq{
+			Segment:st.Segment,
+			Duration:st.Duration,
+			Length:st.Length,
+			Retain:st.Retain,
+		},
+		sourceReq:sourceReq{
+			DialTimeout:st.DialTimeout,
+			ReadTimeout:st.ReadTimeout,
+			KeepAlive:st.KeepAlive,
+			Failover:st.Failover,
+			OnDemand:st.OnDemand,
+			Idle:st.Idle,
+		},
+	}
+}
+
+//hlsConf merge the setting of request into the global hls config
+func (s *Server) hlsConf(req *hlsReq) (stream.HlsConf,error) {
+	var (
+		conf = s.config()
+		hc stream.HlsConf
+		err error
+		segment = conf.Hls.Segment
+	)
+	if req.Segment!=""{
+		segment = req.Segment
+	}
+	hc.Segment,err = stream.ParseSegmentFormat(segment)
+	if err!= nil{
+		return hc,err
+	}
+	hc.Duration = conf.Hls.Duration
+	if req.Duration!=""{
+		hc.Duration,err = time.ParseDuration(req.Duration)
+		if err!= nil{
+			return hc,err
+		}
+	}
+	hc.Length = conf.Hls.Length
+	if req.Length>0{
+		hc.Length = req.Length
+	}
+	//the global retain is too small for the length of stream, it is derived
+	//from the length instead
+	if conf.Hls.Retain>hc.Length{
+		hc.Retain = conf.Hls.Retain
+	}
+	if req.Retain>0{
+		hc.Retain = req.Retain
+	}
+	if hc.Duration<0 || hc.Length<0 || hc.Retain<0{
+		return hc,fmt.Errorf("hls setting must not be negative")
+	}
+	if hc.Retain!=0 && hc.Retain<=hc.Length{
+		return hc,fmt.Errorf("hls retain must bigger than length")
+	}
+	if conf.Dvr.Enable{
+		hc.Dvr = &stream.DvrConf{
+			Dir:conf.Dvr.Dir,
+			Window:conf.Dvr.Window,
+			MaxBytes:conf.Dvr.MaxBytes,
+		}
+	}
+	return hc,nil
+}
+
+//sourceConf merge the setting of request into the global source config
+func (s *Server) sourceConf(req *sourceReq) (stream.SourceConf,error) {
+	var (
+		conf = s.config()
+		sc = stream.SourceConf{
+			DialTimeout:conf.Source.DialTimeout,
+			ReadTimeout:conf.Source.ReadTimeout,
+			KeepAlive:conf.Source.KeepAlive,
+			Failover:conf.Source.Failover,
+			OnDemand:conf.Source.OnDemand,
+			Idle:conf.Source.Idle,
+		}
+		err error
+	)
+	if req.DialTimeout!=""{
+		sc.DialTimeout,err = time.ParseDuration(req.DialTimeout)
+		if err!= nil{
+			return sc,err
+		}
+	}
+	if req.ReadTimeout!=""{
+		sc.ReadTimeout,err = time.ParseDuration(req.ReadTimeout)
+		if err!= nil{
+			return sc,err
+		}
+	}
+	if req.KeepAlive!=""{
+		sc.KeepAlive,err = time.ParseDuration(req.KeepAlive)
+		if err!= nil{
+			return sc,err
+		}
+	}
+	if req.Failover!=""{
+		sc.Failover,err = time.ParseDuration(req.Failover)
+		if err!= nil{
+			return sc,err
+		}
+	}
+	if req.OnDemand!= nil{
+		sc.OnDemand = *req.OnDemand
+	}
+	if req.Idle!=""{
+		sc.Idle,err = time.ParseDuration(req.Idle)
+		if err!= nil{
+			return sc,err
+		}
+	}
+	if sc.DialTimeout<0 || sc.ReadTimeout<0 || sc.KeepAlive<0 || sc.Failover<0 || sc.Idle<0{
+		return sc,fmt.Errorf("source timeouts must not be negative")
+	}
+	return sc,nil
+}
+
+func (s *Server) listStreams(w http.ResponseWriter,req *http.Request) {
+	var (
+		list = []*streamResp{}
+	)
+	s.mu.RLock()
+	for _,stm:=range s.streams{
+		list=append(list,toResp(stm))
+	}
+	s.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Id<list[j].Id
+	})
+	writeJson(w,http.StatusOK,list)
+}
+
+func (s *Server) getStream(w http.ResponseWriter,req *http.Request) {
+	s.mu.RLock()
+	stm,ok:=s.streams[mux.Vars(req)["id"]]
+	s.mu.RUnlock()
+	if !ok{
+		writeErr(w,http.StatusNotFound,stream.ErrNotAdd)
+		return
+	}
+	writeJson(w,http.StatusOK,toResp(stm))
+}
+
+func (s *Server) getStats(w http.ResponseWriter,req *http.Request) {
+	s.mu.RLock()
+	stm,ok:=s.streams[mux.Vars(req)["id"]]
+	s.mu.RUnlock()
+	if !ok{
+		writeErr(w,http.StatusNotFound,stream.ErrNotAdd)
+		return
+	}
+	st := stm.Stats()
+	resp := &statsResp{
+		Id:stm.Id(),
+		Url:stm.Path(),
+		Source:st.Source,
+		Connected:st.Connected,
+		Uptime:st.Uptime.Seconds(),
+		Reconnects:st.Reconnects,
+		LastError:st.LastError,
+		Bytes:st.Bytes,
+		Bitrate:st.Bitrate,
+	}
+	if !st.LastErrorAt.IsZero(){
+		resp.LastErrorAt = &st.LastErrorAt
+	}
+	if !st.LastPacketAt.IsZero(){
+		resp.LastPacketAt = &st.LastPacketAt
+	}
+	if v:=st.Video;v!= nil{
+		resp.Video = &videoStats{
+			Codec:v.Codec,
+			Width:v.Width,
+			Height:v.Height,
+			Fps:v.Fps,
+			Gop:v.Gop,
+			GopDuration:v.GopDuration.Seconds(),
+		}
+	}
+	if a:=st.Audio;a!= nil{
+		resp.Audio = &audioStats{
+			Codec:a.Codec,
+			SampleRate:a.SampleRate,
+			Channels:a.Channels,
+		}
+	}
+	writeJson(w,http.StatusOK,resp)
+}
+
+func (s *Server) createStream(w http.ResponseWriter,req *http.Request) {
+	var (
+		body streamReq
+	)
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if err!= nil{
+		writeErr(w,http.StatusBadRequest,err)
+		return
+	}
+	stm,err := s.AddStream(&body)
+	switch err {
+	case nil:
+	case stream.ErrHadAdd:
+		writeErr(w,http.StatusConflict,err)
+		return
+	default:
+		writeErr(w,http.StatusBadRequest,err)
+		return
+	}
+	writeJson(w,http.StatusCreated,toResp(stm))
+}
+
+func (s *Server) deleteStream(w http.ResponseWriter,req *http.Request) {
+	err := s.DelStream(mux.Vars(req)["id"])
+	if err!= nil{
+		writeErr(w,http.StatusNotFound,err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//createToken sign a playback token for the stream
+func (s *Server) createToken(w http.ResponseWriter,req *http.Request) {
+	var (
+		body tokenReq
+		ttl = s.config().Token.Ttl
+		err error
+	)
+	if s.signer==nil{
+		writeErr(w,http.StatusNotFound,fmt.Errorf("token is not enabled"))
+		return
+	}
+	s.mu.RLock()
+	stm,ok:=s.streams[mux.Vars(req)["id"]]
+	s.mu.RUnlock()
+	if !ok{
+		writeErr(w,http.StatusNotFound,stream.ErrNotAdd)
+		return
+	}
+	//body is optional
+	if err = json.NewDecoder(req.Body).Decode(&body);err!= nil && err!=io.EOF{
+		writeErr(w,http.StatusBadRequest,err)
+		return
+	}
+	if body.Ttl!=""{
+		if ttl,err = time.ParseDuration(body.Ttl);err!= nil{
+			writeErr(w,http.StatusBadRequest,err)
+			return
+		}
+	}
+	if ttl<=0{
+		writeErr(w,http.StatusBadRequest,fmt.Errorf("ttl must be positive"))
+		return
+	}
+	if body.Ip!=""{
+		ip := net.ParseIP(body.Ip)
+		if ip==nil{
+			writeErr(w,http.StatusBadRequest,fmt.Errorf("ip %s invalid",body.Ip))
+			return
+		}
+		body.Ip = ip.String()
+	}
+	expire := time.Now().Add(ttl)
+	token := s.signer.Sign(stm.Id(),expire,body.Ip)
+	writeJson(w,http.StatusCreated,&tokenResp{
+		Stream:stm.Id(),
+		Token:token,
+		Expire:expire.Truncate(time.Second),
+		Url:s.playUrl(stm.Id())+"?"+stream.TokenParam+"="+url.QueryEscape(token),
+	})
+}
+
+//listRecords query the catalog by stream, from and to, the stream may be deleted already
+func (s *Server) listRecords(w http.ResponseWriter,req *http.Request) {
+	var (
+		list = []*recordResp{}
+		query = req.URL.Query()
+		id = query.Get("stream")
+		from,to time.Time
+		err error
+	)
+	if s.catalog==nil{
+		writeErr(w,http.StatusNotFound,fmt.Errorf("save is not enabled"))
+		return
+	}
+	if v,ok:=mux.Vars(req)["id"];ok{
+		id = v
+	}
+	if v:=query.Get("from");v!=""{
+		if from,err = stream.ParseTime(v);err!= nil{
+			writeErr(w,http.StatusBadRequest,err)
+			return
+		}
+	}
+	if v:=query.Get("to");v!=""{
+		if to,err = stream.ParseTime(v);err!= nil{
+			writeErr(w,http.StatusBadRequest,err)
+			return
+		}
+	}
+	for _,r:=range s.catalog.Query(id,from,to){
+		resp := &recordResp{
+			Stream:r.Id,
+			Name:r.Name,
+			Start:r.Start,
+			Size:r.Size,
+			Codec:r.Codec,
+			Event:r.Event,
+			Path:r.Path,
+			Url:s.vod.Path(r),
+		}
+		if !r.Writing{
+			end := r.End()
+			resp.End = &end
+		}
+		list = append(list,resp)
+	}
+	writeJson(w,http.StatusOK,list)
+}
+
+//createEvent record the stream around now, the event in recording is extended
+func (s *Server) createEvent(w http.ResponseWriter,req *http.Request) {
+	var (
+		body eventReq
+		pre,post time.Duration
+		err error
+	)
+	if s.save==nil{
+		writeErr(w,http.StatusNotFound,fmt.Errorf("save is not enabled"))
+		return
+	}
+	s.mu.RLock()
+	stm,ok:=s.streams[mux.Vars(req)["id"]]
+	s.mu.RUnlock()
+	if !ok{
+		writeErr(w,http.StatusNotFound,stream.ErrNotAdd)
+		return
+	}
+	//body is optional
+	if err = json.NewDecoder(req.Body).Decode(&body);err!= nil && err!=io.EOF{
+		writeErr(w,http.StatusBadRequest,err)
+		return
+	}
+	//the default pre-roll is used if not set, 0 is no pre-roll
+	pre = -1
+	if body.PreRoll!=""{
+		if pre,err = time.ParseDuration(body.PreRoll);err!= nil{
+			writeErr(w,http.StatusBadRequest,err)
+			return
+		}
+		if pre<0{
+			writeErr(w,http.StatusBadRequest,fmt.Errorf("pre-roll must not be negative"))
+			return
+		}
+	}
+	if body.PostRoll!=""{
+		if post,err = time.ParseDuration(body.PostRoll);err!= nil{
+			writeErr(w,http.StatusBadRequest,err)
+			return
+		}
+	}
+	ev,err := s.save.Event(stm,body.Name,pre,post)
+	if err!= nil{
+		writeErr(w,http.StatusBadRequest,err)
+		return
+	}
+	writeJson(w,http.StatusAccepted,&eventResp{
+		Stream:ev.Stream,
+		Name:ev.Name,
+		At:ev.At,
+		Until:ev.Until,
+		PreRoll:ev.PreRoll.String(),
+	})
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/yylt/rtspmux/config"
+	"github.com/yylt/rtspmux/stream"
+)
+
+func TestApiAuth(t *testing.T) {
+	stm,err := stream.NewStream("rtsp://10.0.0.1/main",nil)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	signer,err := stream.NewSigner([]byte("secret"))
+	if err!= nil{
+		t.Fatal(err)
+	}
+	s := &Server{
+		r:mux.NewRouter(),
+		streams:map[string]*stream.Stream{stm.Id():stm},
+		signer:signer,
+		liveprefix:"/live",
+	}
+	s.conf.Store(&config.Config{
+		Token:&config.TokenConfig{Key:"secret",Ttl:time.Hour},
+		Api:&config.ApiConfig{Key:"admin"},
+	})
+	s.apiRoute(s.r.PathPrefix("/api").Subrouter())
+	mint := func(auth string) int {
+		req := httptest.NewRequest(http.MethodPost,"/api/streams/"+stm.Id()+"/tokens",nil)
+		if auth!=""{
+			req.Header.Set("Authorization",auth)
+		}
+		w := httptest.NewRecorder()
+		s.r.ServeHTTP(w,req)
+		return w.Code
+	}
+	if code:=mint("");code!=http.StatusUnauthorized{
+		t.Errorf("mint without key got %d, want 401",code)
+	}
+	if code:=mint("Bearer wrong");code!=http.StatusUnauthorized{
+		t.Errorf("mint with wrong key got %d, want 401",code)
+	}
+	if code:=mint("Bearer admin");code!=http.StatusCreated{
+		t.Errorf("mint with key got %d, want 201",code)
+	}
+	//token key without api key is refused
+	conf := config.Config{
+		Save:&config.SaveConfig{},
+		Hls:&config.HlsConfig{},
+		Dvr:&config.DvrConfig{},
+		Source:&config.SourceConfig{},
+		Webhook:&config.WebhookConfig{},
+		Token:&config.TokenConfig{Key:"secret"},
+		Api:&config.ApiConfig{},
+	}
+	if err = conf.Valid();err==nil || !strings.Contains(err.Error(),"api key"){
+		t.Errorf("token key without api key should be invalid, got %v",err)
+	}
+}
+
+func TestHlsConfLength(t *testing.T) {
+	s := &Server{}
+	s.conf.Store(&config.Config{
+		Hls:&config.HlsConfig{Duration:time.Second*2,Length:3,Retain:6},
+		Dvr:&config.DvrConfig{},
+	})
+	for _,tc:=range []struct{
+		req hlsReq
+		want int
+		fail bool
+	}{
+		{hlsReq{},6,false},
+		//the global retain is too small, so it is derived
+		{hlsReq{Length:10},0,false},
+		{hlsReq{Length:10,Retain:12},12,false},
+		{hlsReq{Length:10,Retain:8},0,true},
+	}{
+		hc,err := s.hlsConf(&tc.req)
+		if tc.fail{
+			if err==nil{
+				t.Errorf("%+v should fail",tc.req)
+			}
+			continue
+		}
+		if err!= nil || hc.Retain!=tc.want{
+			t.Errorf("%+v want retain %d, got %d err %v",tc.req,tc.want,hc.Retain,err)
+		}
+	}
+}
+
+func TestAuthorizeVod(t *testing.T) {
+	signer,err := stream.NewSigner([]byte("secret"))
+	if err!= nil{
+		t.Fatal(err)
+	}
+	s := &Server{signer:signer}
+	h := s.authorize("/vod", func(w http.ResponseWriter,req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	get := func(p string) int {
+		w := httptest.NewRecorder()
+		h(w,httptest.NewRequest(http.MethodGet,p,nil))
+		return w.Code
+	}
+	expire := time.Now().Add(time.Hour)
+	for _,tc:=range []struct{
+		path string
+		code int
+	}{
+		{"/vod/cam/index.m3u8",http.StatusUnauthorized},
+		{"/vod/cam/cam-1000.mp4?token="+signer.Sign("other",expire,""),http.StatusForbidden},
+		{"/vod/cam/cam-1000.mp4?token="+signer.Sign("cam",expire,""),http.StatusOK},
+		{"/vod/cam/index.m3u8?token="+signer.Sign("cam",expire,""),http.StatusOK},
+	}{
+		if code:=get(tc.path);code!=tc.code{
+			t.Errorf("%s got %d, want %d",tc.path,code,tc.code)
+		}
+	}
+}
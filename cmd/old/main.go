@@ -5,6 +5,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"syscall"
 )
 
 
@@ -20,11 +21,25 @@ func main()  {
 		}
 	}()
 
+	stop := make(chan struct{})
+	if fpath:=config.ConfFile();fpath!=""{
+		if err := srv.watchConf(fpath,stop); err != nil {
+			log.Println("watch config failed",err)
+		}
+	}
+
 	c := make(chan os.Signal, 1)
 
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGHUP)
 
-	<-c
+	for sig:=range c{
+		if sig==syscall.SIGHUP{
+			srv.reload()
+			continue
+		}
+		break
+	}
+	close(stop)
 
 	srv.Stop()
 
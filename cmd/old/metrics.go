@@ -0,0 +1,93 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yylt/rtspmux/stream"
+)
+
+var (
+	//the stream id only, url may change on reload and carry the password
+	streamLabels = []string{"stream"}
+
+	connectedDesc = prometheus.NewDesc("rtspmux_stream_connected",
+		"Whether the source of stream is connected.",streamLabels,nil)
+	uptimeDesc = prometheus.NewDesc("rtspmux_stream_uptime_seconds",
+		"Seconds since the current connection of source established.",streamLabels,nil)
+	reconnectsDesc = prometheus.NewDesc("rtspmux_stream_reconnects_total",
+		"Times the source reconnected successfully.",streamLabels,nil)
+	attemptsDesc = prometheus.NewDesc("rtspmux_stream_connect_attempts_total",
+		"Times the source dialed, failed included.",streamLabels,nil)
+	bytesDesc = prometheus.NewDesc("rtspmux_stream_ingested_bytes_total",
+		"Payload bytes read from the source.",streamLabels,nil)
+	bitrateDesc = prometheus.NewDesc("rtspmux_stream_bitrate_bits",
+		"Input bitrate of the source in bits per second.",streamLabels,nil)
+	lastPacketDesc = prometheus.NewDesc("rtspmux_stream_last_packet_timestamp_seconds",
+		"Unix time of the last packet read from the source.",streamLabels,nil)
+	segmentsDesc = prometheus.NewDesc("rtspmux_hls_segments_total",
+		"HLS segments produced.",streamLabels,nil)
+	requestsDesc = prometheus.NewDesc("rtspmux_hls_requests_total",
+		"HLS requests served.",streamLabels,nil)
+
+	recordWrittenDesc = prometheus.NewDesc("rtspmux_recordings_written_total",
+		"Recording files finished.",streamLabels,nil)
+	recordWrittenBytesDesc = prometheus.NewDesc("rtspmux_recordings_written_bytes_total",
+		"Bytes of the recording files finished.",streamLabels,nil)
+	recordDeletedDesc = prometheus.NewDesc("rtspmux_recordings_deleted_total",
+		"Recording files deleted by retention.",streamLabels,nil)
+	recordDeletedBytesDesc = prometheus.NewDesc("rtspmux_recordings_deleted_bytes_total",
+		"Bytes of the recording files deleted by retention.",streamLabels,nil)
+)
+
+//collector read the counters of streams and saver when scraped
+type collector struct {
+	s *Server
+}
+
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	for _,d:=range []*prometheus.Desc{connectedDesc,uptimeDesc,reconnectsDesc,attemptsDesc,
+		bytesDesc,bitrateDesc,lastPacketDesc,segmentsDesc,requestsDesc,
+		recordWrittenDesc,recordWrittenBytesDesc,recordDeletedDesc,recordDeletedBytesDesc}{
+		ch<-d
+	}
+}
+
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	var (
+		stms []*stream.Stream
+	)
+	c.s.mu.RLock()
+	for _,stm:=range c.s.streams{
+		stms = append(stms,stm)
+	}
+	c.s.mu.RUnlock()
+	for _,stm:=range stms{
+		var (
+			st = stm.Stats()
+			labels = []string{stm.Id()}
+			connected float64
+		)
+		if st.Connected{
+			connected = 1
+		}
+		ch<-prometheus.MustNewConstMetric(connectedDesc,prometheus.GaugeValue,connected,labels...)
+		ch<-prometheus.MustNewConstMetric(uptimeDesc,prometheus.GaugeValue,st.Uptime.Seconds(),labels...)
+		ch<-prometheus.MustNewConstMetric(reconnectsDesc,prometheus.CounterValue,float64(st.Reconnects),labels...)
+		ch<-prometheus.MustNewConstMetric(attemptsDesc,prometheus.CounterValue,float64(st.Attempts),labels...)
+		ch<-prometheus.MustNewConstMetric(bytesDesc,prometheus.CounterValue,float64(st.Bytes),labels...)
+		ch<-prometheus.MustNewConstMetric(bitrateDesc,prometheus.GaugeValue,float64(st.Bitrate),labels...)
+		if !st.LastPacketAt.IsZero(){
+			ch<-prometheus.MustNewConstMetric(lastPacketDesc,prometheus.GaugeValue,
+				float64(st.LastPacketAt.UnixNano())/1e9,labels...)
+		}
+		ch<-prometheus.MustNewConstMetric(segmentsDesc,prometheus.CounterValue,float64(st.Segments),labels...)
+		ch<-prometheus.MustNewConstMetric(requestsDesc,prometheus.CounterValue,float64(st.Requests),labels...)
+	}
+	if c.s.save!= nil{
+		for id,st:=range c.s.save.Stats(){
+			ch<-prometheus.MustNewConstMetric(recordWrittenDesc,prometheus.CounterValue,float64(st.Written),id)
+			ch<-prometheus.MustNewConstMetric(recordWrittenBytesDesc,prometheus.CounterValue,float64(st.WrittenBytes),id)
+			ch<-prometheus.MustNewConstMetric(recordDeletedDesc,prometheus.CounterValue,float64(st.Deleted),id)
+			ch<-prometheus.MustNewConstMetric(recordDeletedBytesDesc,prometheus.CounterValue,float64(st.DeletedBytes),id)
+		}
+	}
+}
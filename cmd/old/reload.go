@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/yylt/rtspmux/config"
+	"github.com/yylt/rtspmux/stream"
+
+	ants "github.com/panjf2000/ants/v2"
+)
+
+const (
+	//reloadDelay merge the events of one save of config file
+	reloadDelay = time.Millisecond * 500
+)
+
+//streamConf is the setting of stream with the global config merged
+type streamConf struct {
+	req *streamReq
+	hc stream.HlsConf
+	sc stream.SourceConf
+	record bool
+}
+
+//sameSource return whether the source and recording are not changed, the
+//stream must be restarted if not
+func (c *streamConf) sameSource(o *streamConf) bool {
+	return c.req.Url==o.req.Url &&
+		strings.Join(c.req.Backups,"|")==strings.Join(o.req.Backups,"|") &&
+		c.sc==o.sc && c.record==o.record
+}
+
+//resolve merge the global config into the setting of request
+func (s *Server) resolve(req *streamReq) (*streamConf,error) {
+	var (
+		conf = s.config()
+		cs = &streamConf{
+			req:req,
+			record:conf.Save.Continuous,
+		}
+		err error
+	)
+	cs.hc,err = s.hlsConf(&req.hlsReq)
+	if err!= nil{
+		return nil,err
+	}
+	cs.sc,err = s.sourceConf(&req.sourceReq)
+	if err!= nil{
+		return nil,err
+	}
+	if req.Record!= nil{
+		cs.record = *req.Record
+	}
+	//the recorded stream is always connected
+	if cs.record && conf.Save.Enable{
+		cs.sc.OnDemand = false
+	}
+	return cs,nil
+}
+
+func newStream(req *streamReq,pool *ants.Pool) (*stream.Stream,error) {
+	stm,err := stream.NewStream(req.Url,pool)
+	if err!= nil{
+		return nil,err
+	}
+	if req.Name!=""{
+		if err = stm.SetName(req.Name);err!= nil{
+			return nil,err
+		}
+	}
+	return stm,nil
+}
+
+//addConf start the stream from config
+func (s *Server) addConf(cs *streamConf) error {
+	stm,err := s.startStream(cs)
+	if err!= nil{
+		return err
+	}
+	s.mu.Lock()
+	s.confs[stm.Id()] = cs
+	s.mu.Unlock()
+	return nil
+}
+
+//reload read the config file and apply it, the error is printed only
+func (s *Server) reload() {
+	conf,err := config.Reload()
+	if err!= nil{
+		fmt.Println("server","reload config failed",err)
+		return
+	}
+	if err = s.Reload(conf);err!= nil{
+		fmt.Println("server","reload config failed",err)
+		return
+	}
+	fmt.Println("server","config reloaded")
+}
+
+//Reload apply the new config without dropping the unchanged streams. The
+//streams of config are diffed by id, the added are started, the removed
+//are stopped, and the changed are restarted, or updated in place by the
+//handler if only the hls setting changed. The streams added by api
+//are kept. The handler and recording config are replaced in place
+func (s *Server) Reload(conf *config.Config) error {
+	var (
+		next = make(map[string]*streamConf)
+		ids []string
+	)
+	s.reloadmu.Lock()
+	defer s.reloadmu.Unlock()
+	old := s.config()
+	s.conf.Store(conf)
+	err := s.resolveAll(next,&ids)
+	if err==nil && s.save!= nil{
+		var sc *stream.Saveconf
+		if sc,err = s.saveConf();err==nil{
+			err = s.save.Reload(sc)
+		}
+	}
+	if err!= nil{
+		s.conf.Store(old)
+		return err
+	}
+	warnRestart(old,conf)
+	if old.Outformat!=conf.Outformat{
+		if err = s.replaceHandler();err!= nil{
+			fmt.Println("server","replace handler failed",err)
+		}
+	}
+	s.mu.RLock()
+	prev := make(map[string]*streamConf,len(s.confs))
+	for id,cs:=range s.confs{
+		prev[id] = cs
+	}
+	s.mu.RUnlock()
+	for id:=range prev{
+		if _,ok:=next[id];!ok{
+			fmt.Println("server","reload","remove stream",id)
+			s.DelStream(id)
+		}
+	}
+	for _,id:=range ids{
+		cs := next[id]
+		cur,ok := prev[id]
+		switch {
+		case !ok:
+			fmt.Println("server","reload","add stream",id)
+		case !cur.sameSource(cs):
+			fmt.Println("server","reload","restart stream",id)
+			s.delStream(id,false)
+		case !reflect.DeepEqual(cur.hc,cs.hc):
+			fmt.Println("server","reload","update hls of stream",id)
+			if err = s.updateHls(id,cs);err!= nil{
+				fmt.Println("server","reload","stream",id,"failed",err)
+			}
+			continue
+		default:
+			continue
+		}
+		if err = s.addConf(cs);err!= nil{
+			fmt.Println("server","reload","stream",id,"failed",err)
+		}
+	}
+	return nil
+}
+
+//resolveAll resolve the streams of config by id, ids keep the order of config
+func (s *Server) resolveAll(next map[string]*streamConf,ids *[]string) error {
+	for _,st:=range s.config().Streams{
+		cs,err := s.resolve(toReq(st))
+		if err!= nil{
+			return fmt.Errorf("stream %s: %v",st.Url,err)
+		}
+		stm,err := newStream(cs.req,nil)
+		if err!= nil{
+			return fmt.Errorf("stream %s: %v",st.Url,err)
+		}
+		if _,ok:=next[stm.Id()];ok{
+			return fmt.Errorf("stream %s duplicated",stm.Id())
+		}
+		next[stm.Id()] = cs
+		*ids = append(*ids,stm.Id())
+	}
+	return nil
+}
+
+//updateHls apply the new hls setting to the running handler of stream, the
+//source, viewers and segments are kept
+func (s *Server) updateHls(id string,cs *streamConf) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stm,ok := s.streams[id]
+	if !ok{
+		return stream.ErrNotAdd
+	}
+	stm.SetHlsConf(cs.hc)
+	s.confs[id] = cs
+	return s.handle.UpdateStreams(stm)
+}
+
+//replaceHandler register all streams with the handler of new format
+func (s *Server) replaceHandler() error {
+	h,err := s.newHandler(s.config())
+	if err!= nil{
+		return err
+	}
+	s.mu.Lock()
+	for id,stm:=range s.streams{
+		if err = h.AddStreams(stm);err!= nil{
+			fmt.Println("server","stream",id,"add to handler failed",err)
+		}
+	}
+	old := s.handle
+	s.handle = h
+	s.mu.Unlock()
+	old.Stop()
+	return nil
+}
+
+//warnRestart print the setting changed which need restart
+func warnRestart(old,conf *config.Config) {
+	var (
+		changed []string
+	)
+	if old.Addr!=conf.Addr || old.Certf!=conf.Certf || old.Keyf!=conf.Keyf{
+		changed = append(changed,"listen")
+	}
+	if old.Save.Enable!=conf.Save.Enable || old.Save.Dir!=conf.Save.Dir{
+		changed = append(changed,"save.enable","save.dir")
+	}
+	if old.Secrets!=conf.Secrets{
+		changed = append(changed,"secrets")
+	}
+	if !reflect.DeepEqual(old.Webhook,conf.Webhook){
+		changed = append(changed,"webhook")
+	}
+	if !reflect.DeepEqual(old.Token,conf.Token){
+		changed = append(changed,"token")
+	}
+	if len(changed)>0{
+		fmt.Println("server","config",strings.Join(changed,","),"changed, restart to apply")
+	}
+}
+
+//watchConf reload when the config file is written, the directory is
+//watched since editors may replace the file
+func (s *Server) watchConf(fpath string,stop <-chan struct{}) error {
+	w,err := fsnotify.NewWatcher()
+	if err!= nil{
+		return err
+	}
+	fpath = filepath.Clean(fpath)
+	if err = w.Add(filepath.Dir(fpath));err!= nil{
+		w.Close()
+		return err
+	}
+	go func() {
+		var (
+			timer = time.NewTimer(reloadDelay)
+		)
+		defer w.Close()
+		timer.Stop()
+		for {
+			select {
+			case <-stop:
+				timer.Stop()
+				return
+			case ev,ok:=<-w.Events:
+				if !ok{
+					return
+				}
+				if filepath.Clean(ev.Name)!=fpath || ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename)==0{
+					continue
+				}
+				timer.Reset(reloadDelay)
+			case err,ok:=<-w.Errors:
+				if !ok{
+					return
+				}
+				fmt.Println("server","watch config failed",err)
+			case <-timer.C:
+				s.reload()
+			}
+		}
+	}()
+	return nil
+}
@@ -1,38 +1,68 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/yylt/rtspmux/config"
 	"github.com/yylt/rtspmux/stream"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	ants "github.com/panjf2000/ants/v2"
 )
 
+const (
+	snapshotTimeout = time.Second * 10
+)
+
 type Server struct {
-	conf *config.Config
+	//conf is *config.Config, it is replaced on reload
+	conf atomic.Value
 	r *mux.Router
-	streams []*stream.Stream
+	mu sync.RWMutex
+	streams map[string]*stream.Stream
 	pool *ants.Pool
 	save stream.Saver
 	liveprefix string
+	vodprefix string
 	handle stream.Handler
+	vod *stream.Vod
+	catalog *stream.Catalog
+	hook *stream.Webhook
+	signer *stream.Signer
+	secrets stream.Secrets
+	//confs is the streams from config by id, they are diffed on reload
+	confs map[string]*streamConf
+	reloadmu sync.Mutex
 }
 
 func NewServer(conf *config.Config) *Server{
 	route := mux.NewRouter()
+	if err:=conf.Valid();err!= nil{
+		panic(err)
+	}
 	pool,err := ants.NewPool(10)
 	if err!= nil{
 		panic(err)
 	}
 	serv := &Server{
-		conf:conf,
 		r: route,
+		streams: make(map[string]*stream.Stream),
+		confs: make(map[string]*streamConf),
 		pool: pool,
 		liveprefix: "/live",
+		vodprefix: "/vod",
 	}
+	serv.conf.Store(conf)
 	err = serv.probe()
 	if err!= nil{
 		panic(err)
@@ -42,72 +72,349 @@ func NewServer(conf *config.Config) *Server{
 
 func (s *Server) probe() error{
 	var (
+		conf = s.config()
 		err error
 	)
 
-	for _,st:=range s.conf.Froms{
-		stm,err := stream.NewStream(st,s.pool)
+	s.handle,err = s.newHandler(s.config())
+	if err!= nil{
+		return err
+	}
+	//check the global setting before any stream
+	_,err = s.hlsConf(&hlsReq{})
+	if err!= nil{
+		return err
+	}
+	_,err = s.sourceConf(&sourceReq{})
+	if err!= nil{
+		return err
+	}
+	if conf.Secrets!=""{
+		s.secrets,err = stream.LoadSecrets(conf.Secrets)
 		if err!= nil{
 			return err
 		}
-		stm.Start()
-		s.streams=append(s.streams,stm)
 	}
-	switch s.conf.Outformat {
-	case config.HlsFmt:
-		s.handle=stream.NewHlsHandler(s.liveprefix)
-	default:
-		return fmt.Errorf("%v not support",s.conf.Outformat)
+	if conf.Token.Key!=""{
+		s.signer,err = stream.NewSigner([]byte(conf.Token.Key))
+		if err!= nil{
+			return err
+		}
 	}
-	if s.conf.Save.Enable{
-		s.save,err = stream.NewSaveMp4(&stream.Saveconf{
-			Dir:s.conf.Save.Dir,
-			Maxtime:s.conf.Save.Max,
-			Fragtime:s.conf.Save.Interval,
+	if len(conf.Webhook.Urls)>0{
+		s.hook = stream.NewWebhook(&stream.WebhookConf{
+			Urls:conf.Webhook.Urls,
+			Timeout:conf.Webhook.Timeout,
+			Retry:conf.Webhook.Retry,
+			Down:conf.Webhook.Down,
 		})
 	}
+	if conf.Save.Enable{
+		s.catalog,err = stream.OpenCatalog(conf.Save.Dir)
+		if err!= nil{
+			return err
+		}
+		sc,err := s.saveConf()
+		if err!= nil{
+			return err
+		}
+		s.save,err = stream.NewSaveMp4(sc,s.catalog)
+		if err!= nil{
+			return err
+		}
+		s.vod = stream.NewVod(s.catalog,s.vodprefix)
+	}
+	for _,st:=range conf.Streams{
+		cs,err := s.resolve(toReq(st))
+		if err!= nil{
+			return fmt.Errorf("stream %s: %v",st.Url,err)
+		}
+		if err = s.addConf(cs);err!= nil{
+			return fmt.Errorf("stream %s: %v",st.Url,err)
+		}
+	}
+	return nil
+}
+
+func (s *Server) newHandler(conf *config.Config) (stream.Handler,error) {
+	switch conf.Outformat {
+	case config.HlsFmt:
+		return stream.NewHlsHandler(s.liveprefix),nil
+	case config.FlvFmt:
+		return stream.NewFlvHandler(s.liveprefix),nil
+	case config.DashFmt:
+		return stream.NewDashHandler(s.liveprefix),nil
+	}
+	return nil,fmt.Errorf("%v not support",conf.Outformat)
+}
+
+func (s *Server) config() *config.Config {
+	return s.conf.Load().(*config.Config)
+}
 
+//handler return the output handler, it is replaced on reload
+func (s *Server) handler() stream.Handler {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.handle
+}
+
+func (s *Server) saveConf() (*stream.Saveconf,error) {
+	conf := s.config()
+	format,err := stream.ParseRecordFormat(conf.Save.Format)
 	if err!= nil{
-		return err
+		return nil,err
+	}
+	return &stream.Saveconf{
+		Dir:conf.Save.Dir,
+		Format:format,
+		Maxtime:conf.Save.Max,
+		Fragtime:conf.Save.Interval,
+		MaxBytes:conf.Save.MaxBytes,
+		MaxTotalBytes:conf.Save.MaxTotal,
+		MinFree:conf.Save.MinFree,
+		PreRoll:conf.Save.PreRoll,
+		PostRoll:conf.Save.PostRoll,
+		Hook:s.hooker(),
+	},nil
+}
+
+//AddStream start the stream of request, and register it with the handler,
+//the empty setting of request is the global config
+func (s *Server) AddStream(req *streamReq) (*stream.Stream,error){
+	cs,err := s.resolve(req)
+	if err!= nil{
+		return nil,err
+	}
+	return s.startStream(cs)
+}
+
+func (s *Server) startStream(cs *streamConf) (*stream.Stream,error){
+	var (
+		req = cs.req
+	)
+	stm,err := newStream(req,s.pool)
+	if err!= nil{
+		return nil,err
 	}
+	for _,b:=range req.Backups{
+		if err = stm.AddBackup(b,s.secrets.Lookup("",b));err!= nil{
+			return nil,err
+		}
+	}
+	if err = stm.SetSourceConf(cs.sc);err!= nil{
+		return nil,err
+	}
+	stm.SetHlsConf(cs.hc)
+	stm.SetHook(s.hooker())
+	//the secrets file take precedence over the credential in url
+	if user:=s.secrets.Lookup(req.Name,stm.Path());user!= nil{
+		stm.SetCredential(user)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _,ok:=s.streams[stm.Id()];ok{
+		return nil,stream.ErrHadAdd
+	}
+	//added is sent before start, so it is not after the connected
+	s.notify(stream.HookAdd,stm)
+	stm.Start()
+	err = s.handle.AddStreams(stm)
+	if err!= nil{
+		stm.Stop()
+		s.notify(stream.HookRemove,stm)
+		return nil,err
+	}
+	s.streams[stm.Id()]=stm
+	if s.save!= nil && cs.record{
+		s.save.Start(stm)
+	}
+	return stm,nil
+}
+
+//DelStream unregister the stream from the handler and stop it, the dvr
+//segments on disk are deleted too
+func (s *Server) DelStream(id string) error{
+	return s.delStream(id,true)
+}
+
+//delStream stop the stream, the dvr segments are kept unless purge, so
+//the stream restarted go on with them
+func (s *Server) delStream(id string,purge bool) error{
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stm,ok:=s.streams[id]
+	if !ok{
+		return stream.ErrNotAdd
+	}
+	s.handle.DelStreams(id)
+	stm.Stop()
+	delete(s.streams,id)
+	delete(s.confs,id)
+	if dc:=stm.HlsConf().Dvr;purge && dc!= nil{
+		if err:=stream.RemoveDvr(dc.Dir,id);err!= nil{
+			fmt.Println("server","stream",id,"remove dvr failed",err)
+		}
+	}
+	s.notify(stream.HookRemove,stm)
 	return nil
 }
 
+//hooker return nil interface when webhook is disabled
+func (s *Server) hooker() stream.Hooker {
+	if s.hook==nil{
+		return nil
+	}
+	return s.hook
+}
+
+func (s *Server) notify(typ string,stm *stream.Stream) {
+	if s.hook==nil{
+		return
+	}
+	s.hook.Hook(&stream.HookEvent{
+		Type:typ,
+		Stream:stm.Id(),
+		Url:stm.Path(),
+		At:time.Now(),
+		OnDemand:stm.SourceConf().OnDemand,
+	})
+}
+
 func (s *Server) Stop() {
+	s.reloadmu.Lock()
+	defer s.reloadmu.Unlock()
+	s.mu.Lock()
 	for _,stm :=range s.streams{
 		stm.Stop()
 	}
-	s.save.Stop()
+	s.mu.Unlock()
+	if s.save!= nil{
+		s.save.Stop()
+	}
+	if s.hook!= nil{
+		s.hook.Stop()
+	}
 	s.handle.Stop()
 	s.pool.Release()
 }
 
-func (s *Server) starSave() {
-	if !s.conf.Save.Enable{
+//snapshot return the latest key frame, format is mp4 by default, h264 for
+//annex-b, or jpeg when decoder is configured
+func (s *Server) snapshot(w http.ResponseWriter,req *http.Request) {
+	var (
+		format = req.URL.Query().Get("format")
+		bs []byte
+	)
+	s.mu.RLock()
+	stm,ok:=s.streams[mux.Vars(req)["id"]]
+	s.mu.RUnlock()
+	if !ok{
+		http.NotFound(w,req)
 		return
 	}
-	for _,stm :=range s.streams{
-		s.save.Start(stm.Clone())
+	if format=="jpeg" && s.config().Decoder==""{
+		http.Error(w,"jpeg decoder is not configured",http.StatusBadRequest)
+		return
+	}
+	ctx,cancel := context.WithTimeout(req.Context(),snapshotTimeout)
+	defer cancel()
+	snap,err := stm.Snapshot(ctx.Done())
+	if err!= nil{
+		http.Error(w,err.Error(),http.StatusServiceUnavailable)
+		return
+	}
+	switch format {
+	case "","mp4":
+		bs,err = snap.Mp4()
+		w.Header().Set("Content-Type","video/mp4")
+	case "h264":
+		bs = snap.AnnexB()
+		w.Header().Set("Content-Type","video/h264")
+	case "jpeg":
+		bs,err = snap.Jpeg(ctx,s.config().Decoder)
+		w.Header().Set("Content-Type","image/jpeg")
+	default:
+		http.Error(w,fmt.Sprintf("format %s not support, only mp4,h264,jpeg",format),http.StatusBadRequest)
+		return
+	}
+	if err!= nil{
+		w.Header().Del("Content-Type")
+		http.Error(w,err.Error(),http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Length", strconv.Itoa(len(bs)))
+	w.Write(bs)
+}
+
+//streamId return the stream id of url under prefix, such as {prefix}/{id}/{id}.m3u8,
+//{prefix}/{id}.flv and {prefix}/{id}/{name}.mp4
+func streamId(prefix string,p string) string {
+	p = strings.TrimPrefix(path.Clean(p),prefix)
+	name := strings.Split(strings.Trim(p,"/"),"/")[0]
+	return strings.TrimSuffix(name,path.Ext(name))
+}
+
+//authorize verify the playback token of the stream under prefix when token
+//key is set
+func (s *Server) authorize(prefix string,next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter,req *http.Request) {
+		if s.signer==nil{
+			next(w,req)
+			return
+		}
+		token := req.URL.Query().Get(stream.TokenParam)
+		if token==""{
+			http.Error(w,"token is required",http.StatusUnauthorized)
+			return
+		}
+		err := s.signer.Verify(token,streamId(prefix,req.URL.Path),stream.ClientIP(req),time.Now())
+		if err!= nil{
+			http.Error(w,err.Error(),http.StatusForbidden)
+			return
+		}
+		next(w,req)
+	}
+}
+
+//playUrl return the live url of stream by outformat
+func (s *Server) playUrl(id string) string {
+	switch s.config().Outformat {
+	case config.FlvFmt:
+		return path.Join(s.liveprefix,id+".flv")
+	case config.DashFmt:
+		return path.Join(s.liveprefix,id,id+".mpd")
 	}
+	return path.Join(s.liveprefix,id,id+".m3u8")
 }
 
 func (s *Server) StartServer() error{
 	var (
 		server http.Server
 	)
-	s.starSave()
+	s.apiRoute(s.r.PathPrefix("/api").Subrouter())
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(&collector{s:s},prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	s.r.Handle("/metrics",promhttp.HandlerFor(reg,promhttp.HandlerOpts{})).Methods(http.MethodGet)
 	s.r.HandleFunc("/", func(writer http.ResponseWriter, request *http.Request) {
-		s.handle.HandlerIndex(writer,request)
+		s.handler().HandlerIndex(writer,request)
 	})
 
-	s.r.PathPrefix(s.liveprefix).HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-		s.handle.HandlerStream(writer,request)
-	})
+	if s.vod!= nil{
+		s.r.PathPrefix(s.vodprefix).HandlerFunc(s.authorize(s.vodprefix,s.vod.HandlerStream))
+	}
+	s.r.HandleFunc(s.liveprefix+"/{id}/snapshot",s.authorize(s.liveprefix,s.snapshot)).Methods(http.MethodGet)
+	s.r.PathPrefix(s.liveprefix).HandlerFunc(s.authorize(s.liveprefix,func(writer http.ResponseWriter, request *http.Request) {
+		s.handler().HandlerStream(writer,request)
+	}))
 
-	server.Addr=s.conf.Addr
+	server.Addr=s.config().Addr
 	server.Handler=s.r
-	if s.conf.Certf!="" &&s.conf.Keyf!=""{
-		return server.ListenAndServeTLS(s.conf.Certf,s.conf.Keyf)
+	if s.config().Certf!="" &&s.config().Keyf!=""{
+		return server.ListenAndServeTLS(s.config().Certf,s.config().Keyf)
 	}
 	return server.ListenAndServe()
 }
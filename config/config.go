@@ -15,6 +15,7 @@ type containerformat int
 const (
 	HlsFmt containerformat =iota
 	FlvFmt
+	DashFmt
 	UnknownFmt
 )
 
@@ -24,6 +25,8 @@ func validFormat(s string) (containerformat,bool){
 		return HlsFmt,true
 	case "flv":
 		return FlvFmt,true
+	case "dash":
+		return DashFmt,true
 	}
 	return UnknownFmt,false
 }
@@ -34,34 +37,146 @@ func (f *containerformat) String() string{
 		return "hls"
 	case FlvFmt:
 		return "flv"
+	case DashFmt:
+		return "dash"
 	}
 	return "unknown"
 }
 
 type SaveConfig struct {
-	Interval time.Duration //每个文件的记录时长
+	Interval time.Duration //duration of each recording file
 	Max time.Duration
 	Dir string
 	Enable bool
+	Format string //fmp4 or mp4
+	MaxBytes int64 //max total size of one stream
+	MaxTotal int64 //max total size of all streams
+	MinFree int64 //min free space of the disk
+	Continuous bool //record all streams continuously
+	PreRoll time.Duration //recorded before the event
+	PostRoll time.Duration //recorded after the event
 }
 
 
+type HlsConfig struct {
+	Segment string //ts or fmp4
+	Duration time.Duration //segment target duration
+	Length int //segments in playlist
+	Retain int //segments kept in memory
+}
+
+type DvrConfig struct {
+	Enable bool
+	Dir string
+	Window time.Duration //max age of segments kept on disk
+	MaxBytes int64 //max total size of one stream, 0 is no limit
+}
+
+type WebhookConfig struct {
+	Urls []string //callback urls, the events are posted as json
+	Timeout time.Duration //timeout of one request
+	Retry time.Duration //max time the failed event is retried
+	Down time.Duration //notify when the stream is down longer, 0 is never
+}
+
+type SourceConfig struct {
+	DialTimeout time.Duration //dial timeout
+	ReadTimeout time.Duration //reconnect when nothing is read in it
+	KeepAlive time.Duration //rtsp keepalive interval
+	Failover time.Duration //switch to the backup when the primary is down longer, and probe the primary at this interval
+	OnDemand bool //dial the source only when requested, the continuously recorded streams are always dialed
+	Idle time.Duration //close the on demand source when not requested in it
+}
+
+type TokenConfig struct {
+	Key string //signing key of the playback token, empty is no check
+	Ttl time.Duration //default ttl of the token
+}
+
+type ApiConfig struct {
+	Key string //key of the management api, sent as Authorization: Bearer {key}, empty is no check
+}
+
+func validSegment(s string) bool{
+	switch s {
+	case "ts","fmp4":
+		return true
+	}
+	return false
+}
+
+//StreamConfig is one stream, the empty option is the global setting
+type StreamConfig struct {
+	Name string `mapstructure:"name"` //stream name used as id, the crc32 of url when empty
+	Url string `mapstructure:"url"`
+	Backups []string `mapstructure:"backups"` //switched to in order when the primary is down
+	Record *bool `mapstructure:"record"` //record continuously, save.continuous when empty
+	Segment string `mapstructure:"segment"`
+	Duration string `mapstructure:"duration"`
+	Length int `mapstructure:"length"`
+	Retain int `mapstructure:"retain"`
+	DialTimeout string `mapstructure:"dial_timeout"`
+	ReadTimeout string `mapstructure:"read_timeout"`
+	KeepAlive string `mapstructure:"keepalive"`
+	Failover string `mapstructure:"failover"`
+	OnDemand *bool `mapstructure:"on_demand"` //dial on demand, source.ondemand when empty
+	Idle string `mapstructure:"idle"`
+}
+
 type Config struct {
-	Froms []string
+	Streams []*StreamConfig
 	Outformat containerformat
 	Save *SaveConfig
+	Hls *HlsConfig
+	Dvr *DvrConfig
+	Source *SourceConfig
+	Webhook *WebhookConfig
+	Token *TokenConfig
+	Api *ApiConfig
+	Secrets string //credentials file of sources, each line is {url or host} {user}:{password}
+	Decoder string //jpeg decoder of snapshot, such as ffmpeg
 	Addr string
 	Certf string
 	Keyf string
 }
 
 func init() {
-	pflag.StringSlice("froms",[]string{},"upper streams, such as rtsp://192.168.1.1:554/camera")
-	pflag.String("outformat","hls","out format,support hls,flv")
+	pflag.StringSlice("froms",[]string{},"upper streams, such as rtsp://192.168.1.1:554/camera, backups follow the primary separated by |")
+	pflag.String("outformat","hls","out format,support hls,flv,dash")
 	pflag.String("save.interval","","save mp4 file interval")
 	pflag.String("save.max","","save mp4 file max time")
 	pflag.String("save.dir","","save mp4 file dir")
 	pflag.Bool("save.enable",false,"open save config")
+	pflag.String("save.format","fmp4","save file format,support fmp4,mp4")
+	pflag.Bool("save.continuous",true,"save mp4 of all streams continuously, or only by events")
+	pflag.String("save.preroll","5s","save mp4 time before event")
+	pflag.String("save.postroll","10s","save mp4 time after event")
+	pflag.String("save.maxbytes","","save mp4 max total size of one stream, such as 10GB")
+	pflag.String("save.maxtotal","","save mp4 max total size of all streams, such as 100GB")
+	pflag.String("save.minfree","","save mp4 min free space of disk, such as 1GB")
+	pflag.String("hls.segment","ts","hls segment format,support ts,fmp4")
+	pflag.String("hls.duration","10s","hls segment target duration")
+	pflag.Int("hls.length",3,"hls segments in playlist")
+	pflag.Int("hls.retain",0,"hls segments kept in memory, 0 is twice the length")
+	pflag.Bool("dvr.enable",false,"keep hls segments on disk for timeshift")
+	pflag.String("dvr.dir","","dvr segments dir")
+	pflag.String("dvr.window","2h","dvr max age of segments")
+	pflag.Int64("dvr.maxbytes",0,"dvr max total bytes of one stream, 0 is no limit")
+	pflag.String("source.dialtimeout","10s","source dial timeout")
+	pflag.String("source.readtimeout","30s","source read timeout, the source is reconnected when nothing is read")
+	pflag.String("source.keepalive","30s","rtsp keepalive interval, 0 is disabled")
+	pflag.String("source.failover","10s","switch to backup source when the source is down that long")
+	pflag.Bool("source.ondemand",false,"dial sources when requested by viewers, recorded streams are always connected")
+	pflag.String("source.idle","1m","close the on demand source when nothing is requested that long")
+	pflag.StringSlice("webhook.urls",[]string{},"webhook urls, events are posted as json")
+	pflag.String("webhook.timeout","5s","webhook request timeout")
+	pflag.String("webhook.retry","5m","webhook max time retrying one event")
+	pflag.String("webhook.down","","webhook notify when stream is down that long, such as 5m")
+	pflag.String("token.key","","hmac key of playback token, live and recording playback require token when set")
+	pflag.String("token.ttl","1h","playback token default ttl")
+	pflag.String("api.key","","bearer key of management api, required when token.key is set")
+	pflag.String("secrets","","secrets file of source credentials, each line is {url or host} {user}:{password}")
+	pflag.String("snapshot.decoder","","ffmpeg compatible binary to decode snapshot into jpeg")
 	pflag.String("addr",":1993","listen addr")
 	pflag.String("cert","","cert file path")
 	pflag.String("key","","key file path")
@@ -78,10 +193,22 @@ func mustFromViper(c *Config) {
 	if c==nil{
 		panic("config is nil")
 	}
-	c.Froms=viper.GetStringSlice("froms")
+	c.Streams=nil
+	err:=viper.UnmarshalKey("streams",&c.Streams)
+	if err!= nil{
+		panic(fmt.Sprintf("streams invalid: %v",err))
+	}
+	//flat froms, backups follow the primary separated by |
+	for _,from:=range viper.GetStringSlice("froms"){
+		urls:=strings.Split(from,"|")
+		c.Streams=append(c.Streams,&StreamConfig{
+			Url:urls[0],
+			Backups:urls[1:],
+		})
+	}
 	outf,ok:=validFormat(viper.GetString("outformat"))
 	if !ok{
-		panic(fmt.Sprintf("outformat not support: %s, only hls,flv",viper.GetString("outformat")))
+		panic(fmt.Sprintf("outformat not support: %s, only hls,flv,dash",viper.GetString("outformat")))
 	}
 	c.Outformat=outf
 	if s:=viper.GetString("save.interval");s!=""{
@@ -102,9 +229,136 @@ func mustFromViper(c *Config) {
 
 	c.Save.Dir=viper.GetString("save.dir")
 	c.Save.Enable=viper.GetBool("save.enable")
+	c.Save.Format=viper.GetString("save.format")
+	if c.Save.Format!="fmp4" && c.Save.Format!="mp4"{
+		panic(fmt.Sprintf("save.format not support: %s, only fmp4,mp4",c.Save.Format))
+	}
+	c.Save.Continuous=viper.GetBool("save.continuous")
+	if s:=viper.GetString("save.preroll");s!=""{
+		du,err:=time.ParseDuration(s)
+		if err!= nil{
+			panic(err)
+		}
+		c.Save.PreRoll=du
+	}
+	if s:=viper.GetString("save.postroll");s!=""{
+		du,err:=time.ParseDuration(s)
+		if err!= nil{
+			panic(err)
+		}
+		c.Save.PostRoll=du
+	}
+	c.Save.MaxBytes=mustSize("save.maxbytes")
+	c.Save.MaxTotal=mustSize("save.maxtotal")
+	c.Save.MinFree=mustSize("save.minfree")
+	c.Hls.Segment=viper.GetString("hls.segment")
+	if !validSegment(c.Hls.Segment){
+		panic(fmt.Sprintf("hls.segment not support: %s, only ts,fmp4",c.Hls.Segment))
+	}
+	if s:=viper.GetString("hls.duration");s!=""{
+		du,err:=time.ParseDuration(s)
+		if err!= nil{
+			panic(err)
+		}
+		c.Hls.Duration=du
+	}
+	c.Hls.Length=viper.GetInt("hls.length")
+	c.Hls.Retain=viper.GetInt("hls.retain")
+	c.Dvr.Enable=viper.GetBool("dvr.enable")
+	c.Dvr.Dir=viper.GetString("dvr.dir")
+	if s:=viper.GetString("dvr.window");s!=""{
+		du,err:=time.ParseDuration(s)
+		if err!= nil{
+			panic(err)
+		}
+		c.Dvr.Window=du
+	}
+	c.Dvr.MaxBytes=viper.GetInt64("dvr.maxbytes")
+	if s:=viper.GetString("source.dialtimeout");s!=""{
+		du,err:=time.ParseDuration(s)
+		if err!= nil{
+			panic(err)
+		}
+		c.Source.DialTimeout=du
+	}
+	if s:=viper.GetString("source.readtimeout");s!=""{
+		du,err:=time.ParseDuration(s)
+		if err!= nil{
+			panic(err)
+		}
+		c.Source.ReadTimeout=du
+	}
+	if s:=viper.GetString("source.keepalive");s!=""{
+		du,err:=time.ParseDuration(s)
+		if err!= nil{
+			panic(err)
+		}
+		c.Source.KeepAlive=du
+	}
+	if s:=viper.GetString("source.failover");s!=""{
+		du,err:=time.ParseDuration(s)
+		if err!= nil{
+			panic(err)
+		}
+		c.Source.Failover=du
+	}
+	c.Source.OnDemand=viper.GetBool("source.ondemand")
+	if s:=viper.GetString("source.idle");s!=""{
+		du,err:=time.ParseDuration(s)
+		if err!= nil{
+			panic(err)
+		}
+		c.Source.Idle=du
+	}
+	c.Webhook.Urls=viper.GetStringSlice("webhook.urls")
+	if s:=viper.GetString("webhook.timeout");s!=""{
+		du,err:=time.ParseDuration(s)
+		if err!= nil{
+			panic(err)
+		}
+		c.Webhook.Timeout=du
+	}
+	if s:=viper.GetString("webhook.retry");s!=""{
+		du,err:=time.ParseDuration(s)
+		if err!= nil{
+			panic(err)
+		}
+		c.Webhook.Retry=du
+	}
+	if s:=viper.GetString("webhook.down");s!=""{
+		du,err:=time.ParseDuration(s)
+		if err!= nil{
+			panic(err)
+		}
+		c.Webhook.Down=du
+	}
+	c.Token.Key=viper.GetString("token.key")
+	if s:=viper.GetString("token.ttl");s!=""{
+		du,err:=time.ParseDuration(s)
+		if err!= nil{
+			panic(err)
+		}
+		c.Token.Ttl=du
+	}
+	c.Api.Key=viper.GetString("api.key")
+	c.Secrets = viper.GetString("secrets")
+	c.Decoder = viper.GetString("snapshot.decoder")
 	c.Addr = viper.GetString("addr")
 }
 
+//mustSize parse size such as 512MB, 10GB or bytes
+func mustSize(key string) int64{
+	s:=strings.TrimSpace(viper.GetString(key))
+	if s==""{
+		return 0
+	}
+	n:=viper.GetSizeInBytes(key)
+	if n==0 && strings.Trim(s,"0")!=""{
+		panic(fmt.Sprintf("%s invalid size: %s",key,s))
+	}
+	return int64(n)
+}
+
 func mustConfigFromFile(fpath string) Config{
 	f,err:=os.Open(fpath)
 	if err!= nil{
@@ -119,18 +373,32 @@ func mustConfigFromFile(fpath string) Config{
 	if strings.HasSuffix(fpath,"toml"){
 		viper.SetConfigType("toml")
 	}
-	var c Config
-	viper.ReadConfig(f)
+	var c = newConfig()
+	err=viper.ReadConfig(f)
 	f.Close()
+	if err!= nil{
+		panic(fmt.Sprintf("read %s failed: %v",fpath,err))
+	}
 	mustFromViper(&c)
 	return c
 }
 
+func newConfig() Config{
+	return Config{
+		Save:new(SaveConfig),
+		Hls:new(HlsConfig),
+		Dvr:new(DvrConfig),
+		Source:new(SourceConfig),
+		Webhook:new(WebhookConfig),
+		Token:new(TokenConfig),
+		Api:new(ApiConfig),
+	}
+}
+
 func ConfigRead() *Config{
 	var (
-		conf Config
+		conf = newConfig()
 	)
-	conf.Save = new(SaveConfig)
 	parse()
 	mustFromViper(&conf)
 	fpath := viper.GetString("conf")
@@ -140,7 +408,46 @@ func ConfigRead() *Config{
 	return &conf
 }
 
+//ConfFile return the config file of --conf, empty if not set
+func ConfFile() string{
+	return viper.GetString("conf")
+}
+
+//Reload read the config file again with the flags, the invalid config
+//return error instead of panic
+func Reload() (conf *Config,err error){
+	defer func() {
+		if r:=recover();r!= nil{
+			err=fmt.Errorf("%v",r)
+		}
+	}()
+	fpath := ConfFile()
+	if fpath==""{
+		return nil,fmt.Errorf("config file is not set")
+	}
+	c := mustConfigFromFile(fpath)
+	if err=c.Valid();err!= nil{
+		return nil,err
+	}
+	return &c,nil
+}
+
 func (c *Config) Valid() error{
+	var (
+		names = make(map[string]bool)
+	)
+	for _,st:=range c.Streams{
+		if st.Url==""{
+			return fmt.Errorf("stream %s url must be set",st.Name)
+		}
+		if st.Name==""{
+			continue
+		}
+		if names[st.Name]{
+			return fmt.Errorf("stream name %s duplicated",st.Name)
+		}
+		names[st.Name]=true
+	}
 	if c.Save.Dir!="" {
 		info,err:=os.Stat(c.Save.Dir)
 		if err!= nil{
@@ -150,7 +457,49 @@ func (c *Config) Valid() error{
 			return fmt.Errorf("%s is not directory",c.Save.Dir)
 		}
 	}
-	if c.Save.Interval!=0{
+	if c.Hls.Length<0 || c.Hls.Retain<0 || c.Hls.Duration<0{
+		return fmt.Errorf("hls length, retain and duration must not be negative")
+	}
+	if c.Hls.Retain!=0 && c.Hls.Retain<=c.Hls.Length{
+		return fmt.Errorf("hls retain must bigger than length")
+	}
+	if c.Dvr.Enable{
+		if c.Dvr.Dir==""{
+			return fmt.Errorf("dvr dir must be set")
+		}
+		if c.Dvr.Window<0 || c.Dvr.MaxBytes<0{
+			return fmt.Errorf("dvr window and maxbytes must not be negative")
+		}
+		err:=os.MkdirAll(c.Dvr.Dir,os.ModePerm)
+		if err!= nil{
+			return err
+		}
+	}
+	if c.Source.DialTimeout<0 || c.Source.ReadTimeout<0 || c.Source.KeepAlive<0 || c.Source.Failover<0{
+		return fmt.Errorf("source timeouts must not be negative")
+	}
+	if c.Source.Idle<0{
+		return fmt.Errorf("source idle must not be negative")
+	}
+	if c.Webhook.Timeout<0 || c.Webhook.Retry<0 || c.Webhook.Down<0{
+		return fmt.Errorf("webhook timeout, retry and down must not be negative")
+	}
+	for _,u:=range c.Webhook.Urls{
+		if !strings.HasPrefix(u,"http://") && !strings.HasPrefix(u,"https://"){
+			return fmt.Errorf("webhook url %s must be http or https",u)
+		}
+	}
+	if c.Token.Ttl<0{
+		return fmt.Errorf("token ttl must not be negative")
+	}
+	//anyone reach the api could mint playback tokens
+	if c.Token.Key!="" && c.Api.Key==""{
+		return fmt.Errorf("api key must be set when token key is set")
+	}
+	if c.Save.PreRoll<0 || c.Save.PostRoll<0{
+		return fmt.Errorf("save preroll and postroll must not be negative")
+	}
+	if c.Save.Interval!=0 && c.Save.Max!=0{
 		if c.Save.Interval > c.Save.Max{
 			return fmt.Errorf("save interval bigger than max")
 		}
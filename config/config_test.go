@@ -1,8 +1,99 @@
 package config
 
-import "testing"
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+)
 
 func TestConfigRead(t *testing.T) {
 	ConfigRead()
 
 }
+
+func TestConfigStreams(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(),"conf.yaml")
+	err := ioutil.WriteFile(fpath,[]byte(`
+froms:
+- rtsp://10.0.0.1/a|rtsp://10.0.0.2/a
+streams:
+- name: door
+  url: rtsp://10.0.0.3/door
+  backups: [rtsp://10.0.0.4/door]
+  record: false
+  length: 6
+  read_timeout: 5s
+`),0644)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	c := mustConfigFromFile(fpath)
+	if len(c.Streams)!=2{
+		t.Fatalf("streams %d, want 2",len(c.Streams))
+	}
+	door := c.Streams[0]
+	if door.Name!="door" || door.Url!="rtsp://10.0.0.3/door" || len(door.Backups)!=1 ||
+		door.Record==nil || *door.Record || door.Length!=6 || door.ReadTimeout!="5s"{
+		t.Fatalf("named stream %+v",door)
+	}
+	flat := c.Streams[1]
+	if flat.Name!="" || flat.Url!="rtsp://10.0.0.1/a" || len(flat.Backups)!=1 || flat.Record!= nil{
+		t.Fatalf("flat stream %+v",flat)
+	}
+	if err = c.Valid();err!= nil{
+		t.Fatal(err)
+	}
+	c.Streams = append(c.Streams,&StreamConfig{Name:"door",Url:"rtsp://10.0.0.5/door"})
+	if c.Valid()==nil{
+		t.Fatal("duplicated name is valid")
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(),"conf.yaml")
+	defer viper.Set("conf","")
+	viper.Set("conf",fpath)
+	err := ioutil.WriteFile(fpath,[]byte("streams:\n- name: door\n  url: rtsp://10.0.0.3/door\n"),0644)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	c,err := Reload()
+	if err!= nil{
+		t.Fatal(err)
+	}
+	if len(c.Streams)!=1 || c.Streams[0].Name!="door"{
+		t.Fatalf("streams %+v",c.Streams)
+	}
+	//the broken file must not stop the server
+	if err = ioutil.WriteFile(fpath,[]byte("streams: [\n"),0644);err!= nil{
+		t.Fatal(err)
+	}
+	if _,err = Reload();err==nil{
+		t.Error("broken config should fail")
+	}
+	if err = ioutil.WriteFile(fpath,[]byte("streams:\n- name: door\n  url: rtsp://a/1\n- name: door\n  url: rtsp://a/2\n"),0644);err!= nil{
+		t.Fatal(err)
+	}
+	if _,err = Reload();err==nil{
+		t.Error("duplicated name should fail")
+	}
+}
+
+func TestConfigHlsLength(t *testing.T) {
+	parse()
+	fpath := filepath.Join(t.TempDir(),"conf.yaml")
+	err := ioutil.WriteFile(fpath,[]byte("hls:\n  length: 10\n"),0644)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	c := mustConfigFromFile(fpath)
+	//retain is derived from length when not set
+	if c.Hls.Length!=10 || c.Hls.Retain!=0{
+		t.Fatalf("hls %+v",c.Hls)
+	}
+	if err = c.Valid();err!= nil{
+		t.Fatal(err)
+	}
+}
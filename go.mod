@@ -5,14 +5,15 @@ go 1.16
 require (
 	github.com/Workiva/go-datastructures v1.0.52
 	github.com/cenkalti/backoff/v4 v4.1.0
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/gorilla/mux v1.7.3
 	github.com/nareix/joy4 v0.0.0-20181022032202-3ddbc8f9d431
 	github.com/oopsguy/m3u8 v0.0.0-20190630112258-4150e93ec8f4
 	github.com/panjf2000/ants/v2 v2.2.2
+	github.com/prometheus/client_golang v1.11.0
 	github.com/spf13/pflag v1.0.5
 	github.com/spf13/viper v1.6.2
 	github.com/stretchr/testify v1.4.0 // indirect
-	golang.org/x/sys v0.0.0-20191228213918-04cbcbbfeed8 // indirect
 	golang.org/x/text v0.3.2 // indirect
 	k8s.io/klog/v2 v2.8.0
 )
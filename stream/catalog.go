@@ -0,0 +1,488 @@
+package stream
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nareix/joy4/format/mp4/mp4io"
+	"github.com/nareix/joy4/utils/bits/pio"
+)
+
+const (
+	catalogName = "recordings.json"
+	//catalogLog is the changes since catalogName saved, one json per line
+	catalogLog = "recordings.log"
+	//catalogCompact is the min changes in log before it is compacted
+	catalogCompact = 256
+)
+
+//Record is one mp4 file written by SaveMp4
+type Record struct {
+	Id string `json:"stream"`
+	Name string `json:"name"`
+	Path string `json:"path"`
+	Start time.Time `json:"start"`
+	Duration time.Duration `json:"duration"`
+	Size int64 `json:"size"`
+	Codec string `json:"codec,omitempty"`
+	//InitSize is the size of ftyp and moov of fragmented mp4, 0 is not fragmented
+	InitSize int64 `json:"init_size,omitempty"`
+	//Writing is set until the file is finished
+	Writing bool `json:"writing,omitempty"`
+	//Event is the name of event triggered the recording, empty for continuous recording
+	Event string `json:"event,omitempty"`
+}
+
+func (r *Record) End() time.Time {
+	return r.Start.Add(r.Duration)
+}
+
+//Catalog is the index of recordings, saved as {dir}/recordings.json
+//and rebuilt from the mp4 files when it is missing. The changes are
+//appended to {dir}/recordings.log, which is merged into the json when it
+//grows longer than the catalog
+type Catalog struct {
+	dir string
+	mu sync.RWMutex
+	records map[string]*Record
+	log *os.File
+	//logged is the number of changes in log
+	logged int
+}
+
+//catalogEntry is one change in log, Record is nil when removed
+type catalogEntry struct {
+	Name string `json:"name"`
+	Record *Record `json:"record,omitempty"`
+}
+
+func OpenCatalog(dir string) (*Catalog,error) {
+	var (
+		records = make(map[string]*Record)
+	)
+	c := &Catalog{
+		dir:dir,
+		records:make(map[string]*Record),
+	}
+	bs,err := ioutil.ReadFile(filepath.Join(dir,catalogName))
+	switch {
+	case err==nil:
+		var list []*Record
+		if err = json.Unmarshal(bs,&list);err!= nil{
+			return nil,fmt.Errorf("catalog %s broken: %v",catalogName,err)
+		}
+		for _,r:=range list{
+			records[r.Name]=r
+		}
+	case os.IsNotExist(err):
+		list,err := scanRecords(dir)
+		if err!= nil{
+			return nil,err
+		}
+		for _,r:=range list{
+			records[r.Name]=r
+		}
+	default:
+		return nil,err
+	}
+	if err = replayLog(filepath.Join(dir,catalogLog),records);err!= nil{
+		return nil,err
+	}
+	for _,r:=range records{
+		//the file may be removed when server is down
+		info,err := os.Stat(r.Path)
+		if err!= nil{
+			continue
+		}
+		//the server crashed when writing, recover what is on disk
+		if r.Writing{
+			r.Writing = false
+			r.Size = info.Size()
+			r.recover()
+		}
+		c.records[r.Name]=r
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c,c.compact()
+}
+
+//replayLog apply the changes in log to records, the last line may be
+//partly written when the server crashed, it is ignored
+func replayLog(fpath string,records map[string]*Record) error {
+	f,err := os.Open(fpath)
+	if os.IsNotExist(err){
+		return nil
+	}
+	if err!= nil{
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte,64*1024),1024*1024)
+	for scanner.Scan(){
+		var ent catalogEntry
+		if err = json.Unmarshal(scanner.Bytes(),&ent);err!= nil{
+			break
+		}
+		if ent.Record==nil{
+			delete(records,ent.Name)
+		}else{
+			records[ent.Name] = ent.Record
+		}
+	}
+	return nil
+}
+
+func (c *Catalog) Dir() string {
+	return c.dir
+}
+
+//Put add or update the recording, and append it to the log
+func (c *Catalog) Put(r *Record) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.records[r.Name]=r
+	return c.append(&catalogEntry{Name:r.Name,Record:r})
+}
+
+//Remove delete the recording from catalog, the file is not touched
+func (c *Catalog) Remove(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _,ok:=c.records[name];!ok{
+		return nil
+	}
+	delete(c.records,name)
+	return c.append(&catalogEntry{Name:name})
+}
+
+//append write one change to the log, the log is compacted when it is
+//longer than the catalog, must be called with c.mu held
+func (c *Catalog) append(ent *catalogEntry) error {
+	bs,err := json.Marshal(ent)
+	if err!= nil{
+		return err
+	}
+	if c.log==nil{
+		c.log,err = os.OpenFile(filepath.Join(c.dir,catalogLog),os.O_CREATE|os.O_WRONLY|os.O_APPEND,0644)
+		if err!= nil{
+			return err
+		}
+	}
+	if _,err = c.log.Write(append(bs,'\n'));err!= nil{
+		return err
+	}
+	c.logged++
+	if c.logged>=catalogCompact && c.logged>len(c.records){
+		return c.compact()
+	}
+	return nil
+}
+
+//compact save the catalog and empty the log, replaying the log again is
+//harmless if the server crash before it is emptied. It must be called with
+//c.mu held
+func (c *Catalog) compact() error {
+	if err:=c.save();err!= nil{
+		return err
+	}
+	c.logged = 0
+	if c.log!= nil{
+		return c.log.Truncate(0)
+	}
+	err := os.Remove(filepath.Join(c.dir,catalogLog))
+	if err!= nil && !os.IsNotExist(err){
+		return err
+	}
+	return nil
+}
+
+//Query return the recordings of stream id overlapping [from,to) sorted by
+//start time, empty id is all streams and zero time is unbounded,
+//the recording in writing is regarded as ending now
+func (c *Catalog) Query(id string,from,to time.Time) []*Record {
+	var (
+		records []*Record
+		now = time.Now()
+	)
+	c.mu.RLock()
+	for _,r:=range c.records{
+		if id!="" && r.Id!=id{
+			continue
+		}
+		end := r.End()
+		if r.Writing{
+			end = now
+		}
+		if !from.IsZero() && !end.After(from){
+			continue
+		}
+		if !to.IsZero() && !r.Start.Before(to){
+			continue
+		}
+		cp := *r
+		records = append(records,&cp)
+	}
+	c.mu.RUnlock()
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Start.Equal(records[j].Start){
+			return records[i].Name<records[j].Name
+		}
+		return records[i].Start.Before(records[j].Start)
+	})
+	return records
+}
+
+//save write the catalog to a temp file and rename it, must be called with c.mu held
+func (c *Catalog) save() error {
+	var (
+		records = make([]*Record,0,len(c.records))
+		fpath = filepath.Join(c.dir,catalogName)
+	)
+	for _,r:=range c.records{
+		records = append(records,r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Name<records[j].Name
+	})
+	bs,err := json.Marshal(records)
+	if err!= nil{
+		return err
+	}
+	f,err := os.Create(fpath+".tmp")
+	if err!= nil{
+		return err
+	}
+	_,err = f.Write(bs)
+	if err==nil{
+		//the content must be on disk before it replace the old
+		err = f.Sync()
+	}
+	if cerr:=f.Close();err==nil{
+		err = cerr
+	}
+	if err!= nil{
+		return err
+	}
+	return os.Rename(fpath+".tmp",fpath)
+}
+
+//scanRecords read all recordings in dir
+func scanRecords(dir string) ([]*Record,error) {
+	var (
+		records []*Record
+	)
+	infos,err := ioutil.ReadDir(dir)
+	if err!= nil{
+		return nil,err
+	}
+	for _,info:=range infos{
+		if info.IsDir() || path.Ext(info.Name())!=".mp4"{
+			continue
+		}
+		id,start,event := splitname(info.Name())
+		if id==""{
+			continue
+		}
+		r := &Record{
+			Id:id,
+			Name:info.Name(),
+			Path:filepath.Join(dir,info.Name()),
+			Start:start,
+			Size:info.Size(),
+		}
+		//the name of event is not in the file name
+		if event{
+			r.Event = recordEvent
+		}
+		r.probe()
+		records = append(records,r)
+	}
+	return records,nil
+}
+
+//probe fill the duration, codec and init size from the file
+func (r *Record) probe() (mp4Info,error) {
+	info,err := probeMp4(r.Path)
+	if err!= nil{
+		return info,err
+	}
+	r.Duration,r.Codec,r.InitSize = info.duration,info.codec,info.initSize
+	return info,nil
+}
+
+//recover probe the file left by crash, and cut the fragment partly written
+func (r *Record) recover() {
+	info,err := r.probe()
+	if err!= nil{
+		fmt.Println("catalog","file",r.Path,"can not be recovered",err)
+		return
+	}
+	if info.initSize>0 && info.complete<r.Size{
+		if err = os.Truncate(r.Path,info.complete);err!= nil{
+			fmt.Println("catalog","file",r.Path,"truncate failed",err)
+			return
+		}
+		r.Size = info.complete
+	}
+}
+
+type mp4Info struct {
+	duration time.Duration
+	codec string
+	initSize int64
+	//complete is the end of the last complete fragment
+	complete int64
+}
+
+//probeMp4 read the duration and codecs from moov, the moov is written at the
+//end of mp4 file, and the duration of fragmented mp4 is the sum of its
+//complete fragments of the first track
+func probeMp4(fpath string) (mp4Info,error) {
+	var (
+		info mp4Info
+		moov *mp4io.Movie
+		trackid uint32
+		timescale int64
+		fragdur int64
+		//pending is the duration of fragment whose mdat is not read
+		pending int64
+	)
+	f,err := os.Open(fpath)
+	if err!= nil{
+		return info,err
+	}
+	defer f.Close()
+	stat,err := f.Stat()
+	if err!= nil{
+		return info,err
+	}
+	atoms,err := mp4io.ReadFileAtoms(f)
+	for _,atom:=range atoms{
+		switch v:=atom.(type) {
+		case *mp4io.Dummy:
+			if off,size:=v.Pos();v.Tag()==mp4io.MDAT && int64(off+size)<=stat.Size(){
+				info.complete = int64(off+size)
+				fragdur += pending
+				pending = 0
+			}
+		case *mp4io.Movie:
+			moov = v
+		case *mp4io.MovieFrag:
+			if info.initSize==0{
+				off,_ := v.Pos()
+				info.initSize = int64(off)
+			}
+			pending += fragDuration(f,v,trackid)
+		}
+		if moov!= nil && trackid==0{
+			if moov.Header==nil || moov.Header.TimeScale<=0 || len(moov.Tracks)==0{
+				return info,fmt.Errorf("%s has invalid moov",fpath)
+			}
+			trackid = uint32(moov.Tracks[0].Header.TrackId)
+			timescale = int64(moov.Tracks[0].Media.Header.TimeScale)
+		}
+	}
+	if moov==nil{
+		if err==nil{
+			err = fmt.Errorf("%s has no moov",fpath)
+		}
+		return info,err
+	}
+	for _,trak:=range moov.Tracks{
+		if trak.Media==nil || trak.Media.Info==nil || trak.Media.Info.Sample==nil || trak.Media.Info.Sample.SampleDesc==nil{
+			continue
+		}
+		desc := trak.Media.Info.Sample.SampleDesc
+		name := ""
+		switch {
+		case desc.AVC1Desc!= nil:
+			name = "h264"
+		case desc.MP4ADesc!= nil:
+			name = "aac"
+		default:
+			continue
+		}
+		if info.codec!=""{
+			info.codec += ","
+		}
+		info.codec += name
+	}
+	if info.initSize>0{
+		if timescale>0{
+			info.duration = time.Duration(fragdur)*time.Second/time.Duration(timescale)
+		}
+		return info,nil
+	}
+	info.duration = time.Duration(moov.Header.Duration)*time.Second/time.Duration(moov.Header.TimeScale)
+	return info,nil
+}
+
+//fragDuration return the duration of track in the fragment, in the timescale
+//of track
+func fragDuration(f *os.File,frag *mp4io.MovieFrag,trackid uint32) int64 {
+	var (
+		dur int64
+	)
+	for _,traf:=range frag.Tracks{
+		if traf.Header==nil || traf.Run==nil{
+			continue
+		}
+		//tfhd is version(1) flags(3) track_ID(4)
+		off,_ := traf.Header.Pos()
+		id := make([]byte,4)
+		if _,err:=f.ReadAt(id,int64(off)+12);err!= nil || pio.U32BE(id)!=trackid{
+			continue
+		}
+		off,size := traf.Run.Pos()
+		trun := make([]byte,size)
+		if _,err:=f.ReadAt(trun,int64(off));err!= nil{
+			continue
+		}
+		dur += trunDuration(trun)
+	}
+	return dur
+}
+
+//trunDuration sum the sample durations of trun box, the entries parsed by
+//mp4io are wrong because it read the first sample with first_sample_flags
+func trunDuration(b []byte) int64 {
+	var (
+		dur int64
+		n = 16
+	)
+	if len(b)<n{
+		return 0
+	}
+	flags := pio.U24BE(b[9:])
+	count := int(pio.U32BE(b[12:]))
+	if flags&mp4io.TRUN_DATA_OFFSET!=0{
+		n += 4
+	}
+	if flags&mp4io.TRUN_FIRST_SAMPLE_FLAGS!=0{
+		n += 4
+	}
+	if flags&mp4io.TRUN_SAMPLE_DURATION==0{
+		return 0
+	}
+	entry := 0
+	for _,f:=range []uint32{mp4io.TRUN_SAMPLE_DURATION,mp4io.TRUN_SAMPLE_SIZE,mp4io.TRUN_SAMPLE_FLAGS,mp4io.TRUN_SAMPLE_CTS}{
+		if flags&f!=0{
+			entry += 4
+		}
+	}
+	for i:=0;i<count && n+4<=len(b);i++{
+		dur += int64(pio.U32BE(b[n:]))
+		n += entry
+	}
+	return dur
+}
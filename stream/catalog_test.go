@@ -0,0 +1,161 @@
+package stream
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCatalog(t *testing.T) {
+	dir,err := ioutil.TempDir("","catalog")
+	if err!= nil{
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestMp4(t,dir,"test",1000,10)
+	writeTestMp4(t,dir,"other",1005,10)
+
+	//rebuilt from files when index is missing
+	c,err := OpenCatalog(dir)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	all := c.Query("",time.Time{},time.Time{})
+	if len(all)!=2 || all[0].Id!="test" || all[0].Codec!="h264" || all[0].Size==0{
+		t.Fatalf("unexpected records %+v",all)
+	}
+	if _,err = os.Stat(filepath.Join(dir,catalogName));err!= nil{
+		t.Fatal(err)
+	}
+
+	writeTestMp4(t,dir,"test",1010,10)
+	err = c.Put(&Record{
+		Id:"test",
+		Name:"test-1010.mp4",
+		Path:filepath.Join(dir,"test-1010.mp4"),
+		Start:time.Unix(1010,0),
+		Duration:time.Second*10,
+	})
+	if err!= nil{
+		t.Fatal(err)
+	}
+	if err = c.Remove("other-1005.mp4");err!= nil{
+		t.Fatal(err)
+	}
+
+	//reloaded from index, the removed file is not scanned again
+	c,err = OpenCatalog(dir)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	for _,tc:=range []struct{
+		id string
+		from,to int64
+		want int
+	}{
+		{"",0,0,2},
+		{"other",0,0,0},
+		{"test",1009,0,2},
+		{"test",1011,0,1},
+		{"test",0,1010,1},
+		{"test",1020,0,0},
+	}{
+		var from,to time.Time
+		if tc.from>0{
+			from = time.Unix(tc.from,0)
+		}
+		if tc.to>0{
+			to = time.Unix(tc.to,0)
+		}
+		if got:=c.Query(tc.id,from,to);len(got)!=tc.want{
+			t.Errorf("query %s [%d,%d) want %d, got %d",tc.id,tc.from,tc.to,tc.want,len(got))
+		}
+	}
+
+	//the index entry is dropped when the file is gone
+	os.Remove(filepath.Join(dir,"test-1000.mp4"))
+	c,err = OpenCatalog(dir)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	if got:=c.Query("",time.Time{},time.Time{});len(got)!=1{
+		t.Errorf("missing file should be dropped, got %d",len(got))
+	}
+}
+
+func TestCatalogLog(t *testing.T) {
+	dir,err := ioutil.TempDir("","catalog")
+	if err!= nil{
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestMp4(t,dir,"test",1000,10)
+	c,err := OpenCatalog(dir)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	index,err := ioutil.ReadFile(filepath.Join(dir,catalogName))
+	if err!= nil{
+		t.Fatal(err)
+	}
+
+	//the change is appended to log, the index is not rewritten
+	writeTestMp4(t,dir,"test",1010,10)
+	err = c.Put(&Record{
+		Id:"test",
+		Name:"test-1010.mp4",
+		Path:filepath.Join(dir,"test-1010.mp4"),
+		Start:time.Unix(1010,0),
+		Duration:time.Second*10,
+	})
+	if err!= nil{
+		t.Fatal(err)
+	}
+	if got,_:=ioutil.ReadFile(filepath.Join(dir,catalogName));string(got)!=string(index){
+		t.Errorf("index rewritten by put")
+	}
+	if c.logged!=1{
+		t.Errorf("want 1 change in log, got %d",c.logged)
+	}
+
+	//a line partly written when crashed is ignored
+	f,err := os.OpenFile(filepath.Join(dir,catalogLog),os.O_WRONLY|os.O_APPEND,0644)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	f.WriteString(`{"name":"test-1000.mp4"`)
+	f.Close()
+	c,err = OpenCatalog(dir)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	if got:=c.Query("test",time.Time{},time.Time{});len(got)!=2{
+		t.Fatalf("want 2 records after replay, got %d",len(got))
+	}
+	if info,err:=os.Stat(filepath.Join(dir,catalogLog));err==nil && info.Size()!=0{
+		t.Errorf("log not emptied when opened, size %d",info.Size())
+	}
+
+	//the log is merged into index when it is longer than the catalog
+	r := c.Query("test",time.Time{},time.Time{})[0]
+	for i:=0;i<catalogCompact;i++{
+		if err = c.Put(r);err!= nil{
+			t.Fatal(err)
+		}
+	}
+	if c.logged!=0{
+		t.Errorf("log not compacted, %d changes",c.logged)
+	}
+	if info,err:=os.Stat(filepath.Join(dir,catalogLog));err!= nil || info.Size()!=0{
+		t.Errorf("log not emptied after compact, %v",err)
+	}
+	c,err = OpenCatalog(dir)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	if got:=c.Query("test",time.Time{},time.Time{});len(got)!=2{
+		t.Errorf("want 2 records after compact, got %d",len(got))
+	}
+}
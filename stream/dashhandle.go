@@ -0,0 +1,531 @@
+package stream
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+)
+
+const (
+	dashIndexHtmlTmp =`
+<html>
+<head>
+	<title>rtspmux</title>
+	<meta charset="utf-8">
+	<script src="https://cdn.dashjs.org/latest/dash.all.min.js"></script>
+</head>
+<body>
+{{- range $s := $.streams -}}
+	<video id="{{- $s.Id }}" controls muted width="640" height="264"></video>
+	<script type="text/javascript">
+		var p{{ $s.Id }} = dashjs.MediaPlayer().create();
+		p{{ $s.Id }}.initialize(document.getElementById('{{- $s.Id }}'), '{{- $s.Path}}', true);
+	</script>
+{{- end }}
+</body>
+</html>
+`
+	//mpdUpdate is the minimumUpdatePeriod of manifest
+	mpdUpdate = time.Second * 2
+	mpdTimeLayout = "2006-01-02T15:04:05.000Z"
+)
+
+type DashHandler struct {
+	sts map[string]*dash
+	mu sync.RWMutex
+	prefix string
+}
+
+//dash segment every track of stream into fmp4 separately
+type dash struct {
+	s *Stream
+	//ast is the availabilityStartTime of manifest
+	ast time.Time
+	tracks []*hls
+	mu sync.Mutex
+	stopch chan struct{}
+}
+
+func NewDashHandler(preroute string) Handler {
+	return &DashHandler{
+		sts:make(map[string]*dash),
+		prefix:preroute,
+	}
+}
+
+func (h *DashHandler) AddStreams(s *Stream) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _,ok:=h.sts[s.Id()];ok{
+		return ErrHadAdd
+	}
+	h.sts[s.Id()]=newDash(s)
+	h.sts[s.Id()].Start()
+	return nil
+}
+
+func (h *DashHandler) DelStreams(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _,ok:=h.sts[id];ok{
+		h.sts[id].Stop()
+		delete(h.sts,id)
+	}
+}
+
+//UpdateStreams apply the hls setting of stream to the hls of every track,
+//the dash is restarted if the target duration changed
+func (h *DashHandler) UpdateStreams(s *Stream) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	d,ok := h.sts[s.Id()]
+	if !ok{
+		return ErrNotAdd
+	}
+	conf := s.HlsConf().withDefault()
+	conf.Segment = Fmp4Segment
+	restart := false
+	d.mu.Lock()
+	for _,t:=range d.tracks{
+		if !t.reconf(conf){
+			restart = true
+		}
+	}
+	d.mu.Unlock()
+	if restart{
+		d.Stop()
+		h.sts[s.Id()] = newDash(s)
+		h.sts[s.Id()].Start()
+	}
+	return nil
+}
+
+func (h *DashHandler) Stop(){
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _,d:=range h.sts{
+		d.Stop()
+	}
+}
+
+//handle {id}.mpd, {track}/init_{n}.mp4 and {track}/{msn}.m4s request
+func (h *DashHandler) HandlerStream(w http.ResponseWriter,req *http.Request) {
+	var (
+		r = strings.TrimPrefix(path.Clean(req.URL.Path),h.prefix)
+		names = strings.Split(strings.Trim(r,"/"),"/")
+		d *dash
+		ok bool
+	)
+	if len(names)<2{
+		http.NotFound(w,req)
+		return
+	}
+	h.mu.RLock()
+	d,ok = h.sts[names[0]]
+	h.mu.RUnlock()
+	if !ok{
+		http.NotFound(w,req)
+		return
+	}
+	d.s.Touch()
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if len(names)==2 && path.Ext(names[1])==".mpd"{
+		bs := withTokenMpd(req,d.Mpd())
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Content-Type", "application/dash+xml")
+		w.Header().Set("Content-Length", strconv.Itoa(len(bs)))
+		w.Write(bs)
+		return
+	}
+	if len(names)!=3{
+		http.NotFound(w,req)
+		return
+	}
+	track,err := d.track(names[1])
+	if err!= nil{
+		http.NotFound(w,req)
+		return
+	}
+	var bs []byte
+	switch path.Ext(names[2]) {
+	case ".mp4":
+		bs,err = track.Init(names[2])
+		w.Header().Set("Content-Type", "video/mp4")
+	case ".m4s":
+		bs,err = track.Ts(req.Context().Done(),names[2])
+		w.Header().Set("Content-Type", "video/iso.segment")
+	default:
+		err = ErrNameIncorrect
+	}
+	if err!= nil{
+		http.Error(w,err.Error(),http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(bs)))
+	w.Write(bs)
+}
+
+//handle index html
+func (h *DashHandler) HandlerIndex(w http.ResponseWriter,req *http.Request) {
+	var (
+		data = make(map[string]interface{})
+		videos []*videoHtml
+		tmpl,_ = template.New("").Parse(dashIndexHtmlTmp)
+	)
+
+	h.mu.RLock()
+	for _,v:=range h.sts{
+		videos=append(videos,&videoHtml{
+			Id:v.s.Id(),
+			Path:path.Join(h.prefix,v.s.Id(),fmt.Sprintf("%s.mpd",v.s.Id())),
+		})
+	}
+	h.mu.RUnlock()
+	data["streams"]=videos
+
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	tmpl.Execute(buf,data)
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(buf.Bytes())))
+	w.Write(buf.Bytes())
+	bufPool.Put(buf)
+}
+
+func newDash(s *Stream) *dash {
+	return &dash{
+		s:s,
+		ast:time.Now(),
+		stopch:make(chan struct{}),
+	}
+}
+
+//Start wait for the codecs of stream, and segment every track by one hls,
+//the packets are read once so all tracks are cut at the key frame of video
+func (d *dash) Start() {
+	go func() {
+		cursor,err := d.s.Cursor(d.stopch)
+		if err!= nil{
+			fmt.Println("dash stream",d.s.Path(),"failed",err)
+			return
+		}
+		cds,err := cursor.Streams()
+		if err!= nil{
+			fmt.Println("dash stream",d.s.Path(),"failed",err)
+			return
+		}
+		var (
+			sgs []*segmenter
+			lead *segmenter
+		)
+		d.mu.Lock()
+		select {
+		case <-d.stopch:
+			d.mu.Unlock()
+			return
+		default:
+		}
+		for i,cd:=range cds{
+			h := newHls(d.s)
+			h.conf.Segment = Fmp4Segment
+			h.track = int8(i)
+			d.tracks = append(d.tracks,h)
+			sg := &segmenter{h:h,mux:&fmp4SegmentMuxer{}}
+			if lead==nil && cd.Type().IsVideo(){
+				lead = sg
+			}
+			sgs = append(sgs,sg)
+		}
+		d.mu.Unlock()
+		defer func() {
+			for _,sg:=range sgs{
+				sg.h.releaseBuf()
+			}
+		}()
+		for _,sg:=range sgs{
+			if sg!=lead{
+				sg.lead = lead
+			}
+			if err = sg.header(cds);err!= nil{
+				fmt.Println("dash stream",d.s.Path(),"failed",err)
+				return
+			}
+		}
+		err = d.segment(cursor,sgs,lead)
+		fmt.Println("dash stream",d.s.Path(),"stopped",err)
+	}()
+}
+
+//segment write packets into the segmenter of its track. The packets of other
+//tracks are held until the video reach their time, so they are cut exactly
+//where the video is cut
+func (d *dash) segment(cursor av.Demuxer,sgs []*segmenter,lead *segmenter) error {
+	var (
+		pending []av.Packet
+	)
+	flush := func(all bool) error {
+		n := 0
+		for ;n<len(pending);n++{
+			if !all && pending[n].Time>lead.last{
+				break
+			}
+			if err:=sgs[pending[n].Idx].writePacket(pending[n]);err!= nil{
+				return err
+			}
+		}
+		pending = append(pending[:0],pending[n:]...)
+		return nil
+	}
+	for {
+		select {
+		case <-d.stopch:
+			return nil
+		default:
+		}
+		pkt,err := cursor.ReadPacket()
+		if err!= nil{
+			return err
+		}
+		if int(pkt.Idx)>=len(sgs){
+			continue
+		}
+		//source reconnected, timestamps start over
+		if sg:=sgs[pkt.Idx];sg.seg!= nil && pkt.Time+time.Second<sg.last{
+			if err = flush(true);err!= nil{
+				return err
+			}
+			cds,err := cursor.Streams()
+			if err!= nil{
+				return err
+			}
+			for _,sg:=range sgs{
+				sg.closeSegment(sg.last+sg.frame)
+				if err = sg.header(cds);err!= nil{
+					return err
+				}
+				sg.disc = true
+			}
+		}
+		switch {
+		case lead==nil:
+			err = sgs[pkt.Idx].writePacket(pkt)
+		case sgs[pkt.Idx]==lead:
+			if err = lead.writePacket(pkt);err==nil{
+				err = flush(false)
+			}
+		case pkt.Time>lead.last+time.Second:
+			//the video is missing, do not hold the others
+			pending = append(pending,pkt)
+			err = flush(true)
+		default:
+			pending = append(pending,pkt)
+		}
+		if err!= nil{
+			return err
+		}
+	}
+}
+
+func (d *dash) Stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	close(d.stopch)
+	for _,h:=range d.tracks{
+		h.Stop()
+	}
+}
+
+func (d *dash) track(name string) (*hls,error) {
+	i,err := strconv.Atoi(name)
+	if err!= nil{
+		return nil,err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if i<0 || i>=len(d.tracks){
+		return nil,ErrNameIncorrect
+	}
+	return d.tracks[i],nil
+}
+
+//dashPeriod is where the first segment of an init section start, it is
+//pinned so the period does not move with the window
+type dashPeriod struct {
+	//start is the decode time, at is the wall clock of it
+	start time.Duration
+	at time.Time
+}
+
+//dashSeg is the segment listed in manifest
+type dashSeg struct {
+	msn int
+	initid int
+	start time.Duration
+	duration time.Duration
+	at time.Time
+	size int
+}
+
+//segments return the completed segments in window and the start of periods
+func (h *hls) segments() ([]dashSeg,[]av.CodecData,map[int]dashPeriod) {
+	var (
+		segs []dashSeg
+	)
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	first := h.seq - h.conf.Length
+	if first<h.base{
+		first = h.base
+	}
+	for msn:=first;msn<h.seq;msn++{
+		seg := h.tslist[msn%len(h.tslist)]
+		if seg.seq!=msn || !seg.done{
+			continue
+		}
+		segs = append(segs,dashSeg{
+			msn:msn,
+			initid:seg.initid,
+			start:seg.start,
+			duration:seg.duration,
+			at:seg.at,
+			size:seg.buf.Len(),
+		})
+	}
+	periods := make(map[int]dashPeriod,len(h.periods))
+	for id,p:=range h.periods{
+		periods[id] = p
+	}
+	return segs,h.cds,periods
+}
+
+//Mpd generate the dynamic manifest, every init section start a period
+func (d *dash) Mpd() []byte {
+	var (
+		now = time.Now()
+		conf = d.s.HlsConf().withDefault()
+		buf bytes.Buffer
+		tracks [][]dashSeg
+		starts []map[int]dashPeriod
+		cds []av.CodecData
+	)
+	d.mu.Lock()
+	for _,h:=range d.tracks{
+		segs,cd,periods := h.segments()
+		if len(cd)==0{
+			segs = nil
+		}
+		tracks = append(tracks,segs)
+		starts = append(starts,periods)
+		if len(cd)>0{
+			cds = append(cds,cd[0])
+		}else{
+			cds = append(cds,nil)
+		}
+	}
+	d.mu.Unlock()
+
+	buf.WriteString(fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" profiles="urn:mpeg:dash:profile:isoff-live:2011" type="dynamic" `+
+		`availabilityStartTime="%s" publishTime="%s" minimumUpdatePeriod="%s" minBufferTime="%s" `+
+		`timeShiftBufferDepth="%s" suggestedPresentationDelay="%s">
+`,
+		d.ast.UTC().Format(mpdTimeLayout),now.UTC().Format(mpdTimeLayout),
+		isoDuration(mpdUpdate),isoDuration(conf.Duration),
+		isoDuration(conf.Duration*time.Duration(conf.Length)),isoDuration(conf.Duration*2)))
+
+	//periods follow the init section of first track, the start of period is
+	//where its first segment started, the window only slide the timeline
+	var periods []int
+	if len(tracks)>0{
+		for _,seg:=range tracks[0]{
+			if len(periods)==0 || periods[len(periods)-1]!=seg.initid{
+				periods = append(periods,seg.initid)
+			}
+		}
+	}
+	for _,initid:=range periods{
+		start := starts[0][initid].at.Sub(d.ast)
+		if start<0{
+			start = 0
+		}
+		buf.WriteString(fmt.Sprintf("  <Period id=\"%d\" start=\"%s\">\n",initid,isoDuration(start)))
+		for i,segs:=range tracks{
+			d.adaptation(&buf,i,cds[i],initid,starts[i][initid].start,segs)
+		}
+		buf.WriteString("  </Period>\n")
+	}
+	buf.WriteString(fmt.Sprintf("  <UTCTiming schemeIdUri=\"urn:mpeg:dash:utc:direct:2014\" value=\"%s\"/>\n",
+		now.UTC().Format(mpdTimeLayout)))
+	buf.WriteString("</MPD>\n")
+	return buf.Bytes()
+}
+
+//adaptation write the segments of initid, pto is the decode time where the period start
+func (d *dash) adaptation(buf *bytes.Buffer,idx int,cd av.CodecData,initid int,pto time.Duration,all []dashSeg) {
+	var (
+		segs []dashSeg
+		size int
+		duration time.Duration
+		timescale int64
+		content,attrs string
+	)
+	for _,seg:=range all{
+		if seg.initid==initid{
+			segs = append(segs,seg)
+			size += seg.size
+			duration += seg.duration
+		}
+	}
+	if len(segs)==0 || cd==nil{
+		return
+	}
+	switch codec:=cd.(type) {
+	case h264parser.CodecData:
+		sps := codec.SPS()
+		timescale = fmp4VideoTimeScale
+		content = "video"
+		attrs = fmt.Sprintf(`codecs="avc1.%02x%02x%02x" width="%d" height="%d"`,
+			sps[1],sps[2],sps[3],codec.Width(),codec.Height())
+	case aacparser.CodecData:
+		timescale = int64(codec.SampleRate())
+		content = "audio"
+		attrs = fmt.Sprintf(`codecs="mp4a.40.%d" audioSamplingRate="%d"`,codec.Config.ObjectType,codec.SampleRate())
+	default:
+		return
+	}
+	bandwidth := int64(1000000)
+	if duration>0{
+		bandwidth = int64(size)*8*int64(time.Second)/int64(duration)
+	}
+	ts := func(t time.Duration) int64 {
+		return int64(t*time.Duration(timescale)/time.Second)
+	}
+	buf.WriteString(fmt.Sprintf(`    <AdaptationSet contentType="%s" mimeType="%s/mp4" segmentAlignment="true" startWithSAP="1">
+      <Representation id="%d" %s bandwidth="%d">
+        <SegmentTemplate timescale="%d" presentationTimeOffset="%d" startNumber="%d" `+
+		`initialization="$RepresentationID$/init_%d.mp4" media="$RepresentationID$/$Number$.m4s">
+          <SegmentTimeline>
+`,content,content,idx,attrs,bandwidth,timescale,ts(pto),segs[0].msn,initid))
+	for _,seg:=range segs{
+		buf.WriteString(fmt.Sprintf("            <S t=\"%d\" d=\"%d\"/>\n",ts(seg.start),ts(seg.duration)))
+	}
+	buf.WriteString("          </SegmentTimeline>\n        </SegmentTemplate>\n      </Representation>\n    </AdaptationSet>\n")
+}
+
+//isoDuration format duration as xs:duration, such as PT1.500S
+func isoDuration(d time.Duration) string {
+	return fmt.Sprintf("PT%0.3fS",d.Seconds())
+}
@@ -0,0 +1,126 @@
+package stream
+
+import (
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/av/pubsub"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+)
+
+//newTestAVStream return a connected stream of h264 video and aac audio
+func newTestAVStream(t *testing.T) *Stream {
+	u,_ := url.Parse("rtsp://127.0.0.1/test")
+	s := &Stream{
+		fp:"test",
+		remote:u,
+		queue:pubsub.NewQueue(),
+		stopch:make(chan struct{}),
+		startch:make(chan struct{}),
+	}
+	s.queue.SetMaxGopCount(packetMaxSize)
+	vcd,err := h264parser.NewCodecDataFromSPSAndPPS(testsps,testpps)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	acd,err := aacparser.NewCodecDataFromMPEG4AudioConfig(aacparser.MPEG4AudioConfig{
+		SampleRate:16000,
+		SampleRateIndex:8,
+		ChannelConfig:1,
+		ChannelLayout:av.CH_MONO,
+		ObjectType:2,
+	})
+	if err!= nil{
+		t.Fatal(err)
+	}
+	s.queue.WriteHeader([]av.CodecData{vcd,acd})
+	close(s.startch)
+	return s
+}
+
+//feedAV write 25fps video from v with a key frame every gop frames, and aac
+//frames of 64ms from a which arrive ahead of the video, return the next times
+func feedAV(s *Stream,v,a time.Duration,dur time.Duration,gop int) (time.Duration,time.Duration) {
+	var (
+		frame = time.Second/25
+		aframe = time.Millisecond*64
+		end = v+dur
+		n int
+	)
+	for v<end{
+		for a<v+time.Millisecond*200{
+			s.queue.WritePacket(av.Packet{Idx:1,IsKeyFrame:true,Time:a,Data:[]byte{0x21,0,0}})
+			a += aframe
+		}
+		s.queue.WritePacket(av.Packet{Idx:0,IsKeyFrame:n%gop==0,Time:v,Data:[]byte{0,0,0,2,0x65,0x88}})
+		v += frame
+		n++
+	}
+	return v,a
+}
+
+func TestDashAligned(t *testing.T) {
+	s := newTestAVStream(t)
+	s.SetHlsConf(HlsConf{Duration:time.Second*2,Length:3})
+	dh := NewDashHandler("/live").(*DashHandler)
+	if err:=dh.AddStreams(s);err!= nil{
+		t.Fatal(err)
+	}
+	defer dh.Stop()
+	d := dh.sts[s.Id()]
+	time.Sleep(time.Millisecond*100)
+
+	v,a := feedAV(s,0,0,time.Second*9,30)
+	d.mu.Lock()
+	tracks := d.tracks
+	d.mu.Unlock()
+	if len(tracks)!=2{
+		t.Fatalf("want 2 tracks, got %d",len(tracks))
+	}
+	waitSeq(t,tracks[0],3)
+	waitSeq(t,tracks[1],3)
+	tracks[0].mu.RLock()
+	if n,seq:=s.Stats().Segments,tracks[0].seq;n!=int64(seq){
+		t.Errorf("%d segments counted, want %d",n,seq)
+	}
+	tracks[0].mu.RUnlock()
+	period := regexp.MustCompile(`<Period id="1" start="[^"]+">`)
+	pto := regexp.MustCompile(`presentationTimeOffset="\d+"`)
+	mpd := string(d.Mpd())
+	first,offsets := period.FindString(mpd),pto.FindAllString(mpd,-1)
+	if first=="" || len(offsets)!=2{
+		t.Fatalf("unexpected manifest:\n%s",mpd)
+	}
+
+	//every segment of audio start at the first audio frame after the video cut
+	vsegs,_,_ := tracks[0].segments()
+	asegs,_,_ := tracks[1].segments()
+	n := 0
+	for i:=range vsegs{
+		if i>=len(asegs) || asegs[i].msn!=vsegs[i].msn{
+			break
+		}
+		n++
+		if diff:=asegs[i].start-vsegs[i].start;diff<0 || diff>=time.Millisecond*64{
+			t.Errorf("segment %d audio start %s, video start %s",vsegs[i].msn,asegs[i].start,vsegs[i].start)
+		}
+	}
+	if n==0{
+		t.Errorf("no segment of audio and video to compare, %d and %d",len(vsegs),len(asegs))
+	}
+
+	//the period is pinned when the window slide
+	feedAV(s,v,a,time.Second*9,30)
+	waitSeq(t,tracks[0],7)
+	mpd = string(d.Mpd())
+	if got:=period.FindString(mpd);got!=first{
+		t.Errorf("period moved from %s to %s",first,got)
+	}
+	if got:=pto.FindAllString(mpd,-1);len(got)!=2 || got[0]!=offsets[0] || got[1]!=offsets[1]{
+		t.Errorf("presentationTimeOffset moved from %v to %v",offsets,got)
+	}
+}
@@ -0,0 +1,95 @@
+package stream
+
+import (
+	"fmt"
+	"time"
+)
+
+//Touch mark the stream is used by viewer, the on demand source is dialed
+//if it is idle. It return true if the source is dialed by this call
+func (s *Stream) Touch() bool {
+	if !s.srcconf.OnDemand{
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastUse = time.Now()
+	if s.pulling!= nil{
+		return false
+	}
+	select {
+	case <-s.stopch:
+		return false
+	default:
+	}
+	var (
+		stop = make(chan struct{})
+		done = make(chan struct{})
+		prev = s.pulled
+	)
+	s.pulling,s.pulled = stop,done
+	go func() {
+		defer close(done)
+		//the last pulling may be still closing the source
+		if prev!= nil{
+			<-prev
+		}
+		s.run(stop,time.Minute * 5)
+	}()
+	go s.watchIdle(stop)
+	fmt.Println("stream",s.Path(),"pull on demand")
+	return true
+}
+
+//watchIdle close the source when the stream is not used in Idle
+func (s *Stream) watchIdle(stop chan struct{}) {
+	var (
+		interval = s.srcconf.Idle / 4
+	)
+	if interval<time.Second{
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopch:
+			s.mu.Lock()
+			close(stop)
+			s.pulling = nil
+			s.mu.Unlock()
+			return
+		case <-ticker.C:
+		}
+		s.mu.Lock()
+		if time.Since(s.lastUse)<s.srcconf.Idle{
+			s.mu.Unlock()
+			continue
+		}
+		close(stop)
+		s.pulling = nil
+		s.keyed = false
+		if s.demux!= nil{
+			s.demux.Close()
+		}
+		if s.pending!= nil{
+			s.pending.Close()
+			s.pending = nil
+		}
+		s.mu.Unlock()
+		s.stats.idle()
+		fmt.Println("stream",s.Path(),"idle, close source")
+		return
+	}
+}
+
+//Pulling return whether the source is pulled, the on demand stream is not
+//pulled when idle
+func (s *Stream) Pulling() bool {
+	if !s.srcconf.OnDemand{
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pulling!= nil
+}
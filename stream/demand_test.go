@@ -0,0 +1,88 @@
+package stream
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/h264parser"
+)
+
+func TestOnDemand(t *testing.T) {
+	var (
+		mu sync.Mutex
+		srcs []*liveSource
+	)
+	cd,err := h264parser.NewCodecDataFromSPSAndPPS(testsps,testpps)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	s,err := NewStream("rtsp://camera/main",nil)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	if err = s.SetSourceConf(SourceConf{OnDemand:true});err==nil{
+		t.Error("on demand without idle should be invalid")
+	}
+	if err = s.SetSourceConf(SourceConf{OnDemand:true,Idle:time.Millisecond*300});err!= nil{
+		t.Fatal(err)
+	}
+	s.dialer = func(src *source) (av.DemuxCloser,error) {
+		mu.Lock()
+		defer mu.Unlock()
+		l := &liveSource{cds:[]av.CodecData{cd},closed:make(chan struct{})}
+		srcs = append(srcs,l)
+		return l,nil
+	}
+	dials := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(srcs)
+	}
+	wait := func(cond func() bool,msg string) {
+		deadline := time.Now().Add(time.Second*5)
+		for time.Now().Before(deadline){
+			if cond(){
+				return
+			}
+			time.Sleep(time.Millisecond*10)
+		}
+		t.Fatalf("%s, stats %+v",msg,s.Stats())
+	}
+	s.Start()
+	defer s.Stop()
+
+	time.Sleep(time.Millisecond*100)
+	if dials()!=0 || s.Pulling(){
+		t.Fatal("on demand source should not be dialed before requested")
+	}
+	if !s.Touch(){
+		t.Error("the first request should dial the source")
+	}
+	wait(func() bool {return s.Stats().Connected},"source should connect")
+	if s.Touch(){
+		t.Error("the source is dialed twice")
+	}
+	//the requests keep the source
+	for i:=0;i<15;i++{
+		time.Sleep(time.Millisecond*100)
+		s.Touch()
+	}
+	if !s.Stats().Connected || dials()!=1{
+		t.Fatalf("source should be kept while requested, dials %d",dials())
+	}
+	wait(func() bool {return !s.Pulling() && !s.Stats().Connected},"idle source should be closed")
+	select {
+	case <-srcs[0].closed:
+	default:
+		t.Error("idle source is not closed")
+	}
+	if st:=s.Stats();st.LastError!=""{
+		t.Errorf("idle is not an error, got %s",st.LastError)
+	}
+	if !s.Touch(){
+		t.Error("the request after idle should dial the source")
+	}
+	wait(func() bool {return s.Stats().Connected && dials()==2},"source should connect again")
+}
@@ -0,0 +1,12 @@
+// +build !linux,!darwin,!freebsd
+
+package stream
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func diskFree(dir string) (int64,error) {
+	return 0,fmt.Errorf("disk free space is not supported on %s",runtime.GOOS)
+}
@@ -0,0 +1,18 @@
+// +build linux darwin freebsd
+
+package stream
+
+import (
+	"syscall"
+)
+
+//diskFree return the bytes available to unprivileged user on the filesystem of dir
+func diskFree(dir string) (int64,error) {
+	var (
+		st syscall.Statfs_t
+	)
+	if err:=syscall.Statfs(dir,&st);err!= nil{
+		return 0,err
+	}
+	return int64(uint64(st.Bavail)*uint64(st.Bsize)),nil
+}
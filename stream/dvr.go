@@ -0,0 +1,278 @@
+package stream
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//DvrConf keep segments of hls on disk for timeshift
+type DvrConf struct {
+	Dir string
+	//Window is the max age of segments kept
+	Window time.Duration
+	//MaxBytes is the max total size of segments of one stream, 0 is no limit
+	MaxBytes int64
+}
+
+//dvrs is the dvr opened by dir, the hls rebuilt of a stream keep writing
+//the dvr of the replaced one
+var dvrs = struct {
+	mu sync.Mutex
+	m map[string]*dvr
+}{m:make(map[string]*dvr)}
+
+//dvr save completed segments into {Dir}/{stream id}/. The media sequence
+//and init sections are numbered by dvr, so they go on when the hls of
+//stream is rebuilt, the files left by last run are removed since the
+//index is in memory
+type dvr struct {
+	c DvrConf
+	dir string
+	mu sync.RWMutex
+	segs []*dvrSeg
+	size int64
+	//discseq is the discontinuity sequence of the first segment
+	discseq int
+
+	//wmu serialize the writers, the replaced hls may be saving its last
+	//segment when the new one start
+	wmu sync.Mutex
+	//seq is the media sequence of the next segment
+	seq int
+	//inits is the init sections on disk by id, initseq is the last id
+	inits map[int][]byte
+	initseq int
+	//writer is the hls saved last segment, the segment of another hls is
+	//a discontinuity
+	writer *hls
+	removed bool
+}
+
+type dvrSeg struct {
+	msn int
+	initid int
+	ext string
+	duration time.Duration
+	size int64
+	at time.Time
+	discontinuity bool
+}
+
+//openDvr return the dvr of stream opened before, or a new one
+func openDvr(c DvrConf,id string) (*dvr,error) {
+	dir := filepath.Join(c.Dir,id)
+	dvrs.mu.Lock()
+	defer dvrs.mu.Unlock()
+	if d,ok:=dvrs.m[dir];ok{
+		d.reconf(c)
+		return d,nil
+	}
+	err := os.RemoveAll(dir)
+	if err!= nil{
+		return nil,err
+	}
+	err = os.MkdirAll(dir,os.ModePerm)
+	if err!= nil{
+		return nil,err
+	}
+	d := &dvr{
+		c:c,
+		dir:dir,
+		inits:make(map[int][]byte),
+	}
+	dvrs.m[dir] = d
+	return d,nil
+}
+
+//RemoveDvr delete the segments of stream on disk, it is called when the
+//stream is deleted, not when its hls is rebuilt
+func RemoveDvr(dir string,id string) error {
+	dir = filepath.Join(dir,id)
+	dvrs.mu.Lock()
+	d,ok := dvrs.m[dir]
+	delete(dvrs.m,dir)
+	dvrs.mu.Unlock()
+	if ok{
+		d.wmu.Lock()
+		defer d.wmu.Unlock()
+		d.removed = true
+	}
+	return os.RemoveAll(dir)
+}
+
+//reconf replace the window and size limit, the segments beyond are evicted
+//at next save
+func (d *dvr) reconf(c DvrConf) {
+	d.mu.Lock()
+	d.c = c
+	d.mu.Unlock()
+}
+
+func (d *dvr) segName(seg *dvrSeg) string {
+	return fmt.Sprintf("dvr_%d%s",seg.msn,seg.ext)
+}
+
+func (d *dvr) initName(id int) string {
+	return fmt.Sprintf("dvr_init_%d.mp4",id)
+}
+
+//save write the segment of w and its init section into disk, then evict old
+//segments. The msn and initid of seg are replaced by the numbers of dvr
+func (d *dvr) save(w *hls,seg *dvrSeg,data []byte,init []byte) error {
+	d.wmu.Lock()
+	defer d.wmu.Unlock()
+	if d.removed{
+		return nil
+	}
+	if init!= nil{
+		seg.initid = d.initOf(init)
+		if seg.initid<0{
+			d.initseq++
+			err := ioutil.WriteFile(filepath.Join(d.dir,d.initName(d.initseq)),init,0644)
+			if err!= nil{
+				return err
+			}
+			d.inits[d.initseq] = init
+			seg.initid = d.initseq
+		}
+	}
+	seg.msn = d.seq
+	if d.writer!= nil && d.writer!=w{
+		seg.discontinuity = true
+	}
+	err := ioutil.WriteFile(filepath.Join(d.dir,d.segName(seg)),data,0644)
+	if err!= nil{
+		return err
+	}
+	d.seq++
+	d.writer = w
+	seg.size = int64(len(data))
+	d.mu.Lock()
+	d.segs = append(d.segs,seg)
+	d.size += seg.size
+	evicted := d.evict(time.Now())
+	d.mu.Unlock()
+
+	for _,old:=range evicted{
+		os.Remove(filepath.Join(d.dir,d.segName(old)))
+	}
+	d.removeInits()
+	return nil
+}
+
+//initOf return the id of init section on disk, -1 if not saved yet, must be
+//called with d.wmu held
+func (d *dvr) initOf(init []byte) int {
+	for id,bs:=range d.inits{
+		if bytes.Equal(bs,init){
+			return id
+		}
+	}
+	return -1
+}
+
+//evict drop segments older than window or beyond the size limit, at least
+//one segment is kept, must be called with d.mu held
+func (d *dvr) evict(now time.Time) []*dvrSeg {
+	var (
+		n int
+	)
+	for n<len(d.segs)-1{
+		seg := d.segs[n]
+		old := d.c.Window>0 && now.Sub(seg.at)>d.c.Window
+		big := d.c.MaxBytes>0 && d.size>d.c.MaxBytes
+		if !old && !big{
+			break
+		}
+		d.size -= seg.size
+		if seg.discontinuity{
+			d.discseq++
+		}
+		n++
+	}
+	evicted := append([]*dvrSeg(nil),d.segs[:n]...)
+	d.segs = d.segs[n:]
+	return evicted
+}
+
+//removeInits delete init sections not referred by any segment, must be
+//called with d.wmu held
+func (d *dvr) removeInits() {
+	d.mu.RLock()
+	used := make(map[int]bool)
+	for _,seg:=range d.segs{
+		used[seg.initid]=true
+	}
+	d.mu.RUnlock()
+	for id:=range d.inits{
+		if !used[id]{
+			os.Remove(filepath.Join(d.dir,d.initName(id)))
+			delete(d.inits,id)
+		}
+	}
+}
+
+//open the file of dvr_{msn}.ts, dvr_{msn}.m4s or dvr_init_{id}.mp4
+func (d *dvr) open(name string) (*os.File,error) {
+	if name!=path.Base(name) || !strings.HasPrefix(name,"dvr_"){
+		return nil,ErrNameIncorrect
+	}
+	return os.Open(filepath.Join(d.dir,name))
+}
+
+//M3u8 list all segments on disk, offset is the EXT-X-START offset in seconds,
+//negative from the end. The playlist grows like EVENT playlist, but old
+//segments are evicted, so EXT-X-PLAYLIST-TYPE is not set
+func (d *dvr) M3u8(preroute string,offset string) ([]byte,error) {
+	var (
+		buf bytes.Buffer
+		version = 6
+		initid = -1
+		target float64
+	)
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _,seg:=range d.segs{
+		if seg.ext==Fmp4Segment.ext(){
+			version = 7
+		}
+	}
+	first := 0
+	if len(d.segs)>0{
+		first = d.segs[0].msn
+	}
+	for _,seg:=range d.segs{
+		target = math.Max(target,seg.duration.Seconds())
+	}
+	buf.WriteString(fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:%d\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:%d\n#EXT-X-DISCONTINUITY-SEQUENCE:%d\n",
+		version,int(math.Ceil(target)),first,d.discseq))
+	if offset!=""{
+		off,err := strconv.ParseFloat(offset,64)
+		if err!= nil{
+			return nil,fmt.Errorf("invalid start %s",offset)
+		}
+		buf.WriteString(fmt.Sprintf("#EXT-X-START:TIME-OFFSET=%0.3f,PRECISE=YES\n",off))
+	}
+	buf.WriteString("\n")
+	for _,seg:=range d.segs{
+		if seg.discontinuity{
+			buf.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if seg.ext==Fmp4Segment.ext() && seg.initid!=initid{
+			initid = seg.initid
+			buf.WriteString(fmt.Sprintf("#EXT-X-MAP:URI=\"%s\"\n",path.Join(preroute,d.initName(initid))))
+		}
+		buf.WriteString(fmt.Sprintf("#EXT-X-PROGRAM-DATE-TIME:%s\n#EXTINF:%0.3f,\n%s\n",
+			seg.at.UTC().Format(mpdTimeLayout),seg.duration.Seconds(),path.Join(preroute,d.segName(seg))))
+	}
+	return buf.Bytes(),nil
+}
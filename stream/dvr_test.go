@@ -0,0 +1,224 @@
+package stream
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDvr(t *testing.T) {
+	dir,err := ioutil.TempDir("","dvr")
+	if err!= nil{
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newTestStream(t)
+	s.SetHlsConf(HlsConf{Duration:time.Second*2,Length:3,Retain:4,Dvr:&DvrConf{Dir:dir,Window:time.Hour}})
+	h := newHls(s)
+	h.Start()
+	defer h.Stop()
+	time.Sleep(time.Millisecond*100)
+
+	feed(s,0,25*20,25)
+	waitSeq(t,h,9)
+
+	h.mu.RLock()
+	d := h.dvr
+	h.mu.RUnlock()
+	if d==nil{
+		t.Fatal("dvr not enabled")
+	}
+	m3u8,err := d.M3u8("/live/test/dvr","-6")
+	if err!= nil{
+		t.Fatal(err)
+	}
+	//all segments are kept on disk, beyond the memory ring
+	for _,want:=range []string{
+		"#EXT-X-MEDIA-SEQUENCE:0\n",
+		"#EXT-X-START:TIME-OFFSET=-6.000,PRECISE=YES",
+		"#EXT-X-PROGRAM-DATE-TIME:",
+		"/live/test/dvr/dvr_0.ts",
+		"/live/test/dvr/dvr_8.ts",
+	}{
+		if !strings.Contains(string(m3u8),want){
+			t.Errorf("playlist miss %s:\n%s",want,m3u8)
+		}
+	}
+	if _,err = d.M3u8("/live/test/dvr","abc");err==nil{
+		t.Errorf("invalid start should fail")
+	}
+	f,err := d.open("dvr_0.ts")
+	if err!= nil{
+		t.Fatal(err)
+	}
+	f.Close()
+	if _,err = d.open("../dvr_0.ts");err==nil{
+		t.Errorf("path outside dvr dir should fail")
+	}
+
+	//limit by bytes, only the newest segments are left
+	d.mu.Lock()
+	d.c.MaxBytes = d.segs[len(d.segs)-1].size*2
+	evicted := d.evict(time.Now())
+	left := len(d.segs)
+	d.mu.Unlock()
+	if len(evicted)==0 || left>2{
+		t.Errorf("evict by bytes failed, evicted %d left %d",len(evicted),left)
+	}
+	//limit by age, at least one segment is kept
+	d.mu.Lock()
+	d.c.MaxBytes = 0
+	d.evict(time.Now().Add(time.Hour*2))
+	left = len(d.segs)
+	d.mu.Unlock()
+	if left!=1{
+		t.Errorf("evict by age should keep one segment, got %d",left)
+	}
+	if _,err = os.Stat(filepath.Join(dir,"test"));err!= nil{
+		t.Error(err)
+	}
+}
+
+//TestDvrRoute request the live and dvr assets of a stream whose id start with dvr
+func TestDvrRoute(t *testing.T) {
+	dir,err := ioutil.TempDir("","dvr")
+	if err!= nil{
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newTestStream(t)
+	s.fp = "dvr-cam"
+	s.SetHlsConf(HlsConf{Duration:time.Second*2,Length:3,Retain:4,Dvr:&DvrConf{Dir:dir,Window:time.Hour}})
+	hh := NewHlsHandler("/live").(*HlsHandler)
+	if err = hh.AddStreams(s);err!= nil{
+		t.Fatal(err)
+	}
+	defer hh.Stop()
+	time.Sleep(time.Millisecond*100)
+	feed(s,0,25*10,25)
+	waitSeq(t,hh.sts[s.Id()],4)
+
+	get := func(p string) (int,string) {
+		w := httptest.NewRecorder()
+		hh.HandlerStream(w,httptest.NewRequest("GET",p,nil))
+		return w.Code,w.Body.String()
+	}
+	for _,c:=range []struct{
+		path string
+		code int
+		want string
+	}{
+		{"/live/dvr-cam/dvr-cam.m3u8",200,"/live/dvr-cam/3.ts"},
+		{"/live/dvr-cam/3.ts",200,""},
+		{"/live/dvr-cam/dvr.m3u8",200,"/live/dvr-cam/dvr/dvr_0.ts"},
+		{"/live/dvr-cam/dvr/dvr_0.ts",200,""},
+		{"/live/dvr-cam/dvr_0.ts",404,""},
+		{"/live/dvr-cam/dvr/0.ts",404,""},
+		{"/live/dvr-cam/dvr/dvr.m3u8",404,""},
+	}{
+		code,body := get(c.path)
+		if code!=c.code || !strings.Contains(body,c.want){
+			t.Errorf("%s: got %d, want %d with %s:\n%s",c.path,code,c.code,c.want,body)
+		}
+	}
+}
+
+//waitDvr wait until n segments are saved
+func waitDvr(t *testing.T,d *dvr,n int) {
+	for i:=0;i<100;i++{
+		d.mu.RLock()
+		saved := len(d.segs)
+		d.mu.RUnlock()
+		if saved>=n{
+			return
+		}
+		time.Sleep(time.Millisecond*50)
+	}
+	t.Fatalf("wait %d dvr segments timeout",n)
+}
+
+//TestDvrKept rebuild the hls of stream, the dvr segments on disk go on
+func TestDvrKept(t *testing.T) {
+	dir,err := ioutil.TempDir("","dvr")
+	if err!= nil{
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newTestStream(t)
+	s.SetHlsConf(HlsConf{Duration:time.Second*2,Length:3,Retain:4,Dvr:&DvrConf{Dir:dir,Window:time.Hour}})
+	hh := NewHlsHandler("/live").(*HlsHandler)
+	if err = hh.AddStreams(s);err!= nil{
+		t.Fatal(err)
+	}
+	defer hh.Stop()
+	time.Sleep(time.Millisecond*100)
+	next := feed(s,0,25*10,25)
+	h := hh.sts[s.Id()]
+	waitSeq(t,h,4)
+	h.mu.RLock()
+	d := h.dvr
+	h.mu.RUnlock()
+	waitDvr(t,d,4)
+
+	//the segment format changed, the hls is replaced
+	s.SetHlsConf(HlsConf{Segment:Fmp4Segment,Duration:time.Second*2,Length:3,Retain:4,Dvr:&DvrConf{Dir:dir,Window:time.Hour}})
+	if err = hh.UpdateStreams(s);err!= nil{
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond*100)
+	next = feed(s,next,25*6,25)
+	nh := hh.sts[s.Id()]
+	waitSeq(t,nh,nh.base+2)
+	nh.mu.RLock()
+	nd := nh.dvr
+	nh.mu.RUnlock()
+	if nd!=d{
+		t.Fatal("dvr should be kept when hls replaced")
+	}
+	waitDvr(t,d,6)
+
+	//the hls restarted from sequence 0, the dvr sequence go on
+	hh.DelStreams(s.Id())
+	if err = hh.AddStreams(s);err!= nil{
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond*100)
+	feed(s,next,25*6,25)
+	waitDvr(t,d,8)
+	m3u8,err := d.M3u8("/live/test/dvr","")
+	if err!= nil{
+		t.Fatal(err)
+	}
+	for _,want:=range []string{
+		"#EXT-X-MEDIA-SEQUENCE:0\n",
+		"/live/test/dvr/dvr_0.ts",
+		"#EXT-X-DISCONTINUITY\n#EXT-X-MAP:URI=\"/live/test/dvr/dvr_init_1.mp4\"",
+		"/live/test/dvr/dvr_7.",
+	}{
+		if !strings.Contains(string(m3u8),want){
+			t.Errorf("playlist miss %s:\n%s",want,m3u8)
+		}
+	}
+	if n:=strings.Count(string(m3u8),"#EXT-X-DISCONTINUITY\n");n<2{
+		t.Errorf("want discontinuity at every rebuild, got %d:\n%s",n,m3u8)
+	}
+	if _,err = os.Stat(filepath.Join(dir,"test","dvr_0.ts"));err!= nil{
+		t.Errorf("dvr file removed by rebuild, %v",err)
+	}
+
+	//only deleting the stream remove the files
+	hh.DelStreams(s.Id())
+	if err = RemoveDvr(dir,s.Id());err!= nil{
+		t.Fatal(err)
+	}
+	if _,err = os.Stat(filepath.Join(dir,"test"));!os.IsNotExist(err){
+		t.Errorf("dvr dir should be removed, %v",err)
+	}
+}
@@ -0,0 +1,176 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nareix/joy4/av"
+)
+
+const (
+	//HookSwitch is fired when the stream fail over or fail back
+	HookSwitch = "source.switched"
+)
+
+var (
+	//failbackMin is the min interval of probing primary
+	failbackMin = time.Second * 5
+)
+
+//source is the upstream url without credentials and its credential
+type source struct {
+	remote *url.URL
+	user *url.Userinfo
+}
+
+func parseSource(s string) (*source,error) {
+	u,err := url.Parse(s)
+	if err!= nil{
+		//the error of url.Parse contain the credentials
+		if uerr,ok:=err.(*url.Error);ok{
+			return nil,fmt.Errorf("source url invalid: %v",uerr.Err)
+		}
+		return nil,err
+	}
+	switch u.Scheme{
+	case "rtsp":
+	case "rtmp":
+	default:
+		return nil,fmt.Errorf("scheme %s not support",u.Scheme)
+	}
+	if u.Host==""{
+		return nil,fmt.Errorf("host is none")
+	}
+	return &source{remote:redact(u),user:u.User},nil
+}
+
+//dialUrl return the source url with credential, it must not be printed
+func (src *source) dialUrl() string {
+	u := *src.remote
+	u.User = expandUser(src.user)
+	return u.String()
+}
+
+//redactErr remove the password from the error of dialing, the escaped forms
+//of it in url, query and path are removed too
+func (src *source) redactErr(err error) error {
+	if src.user==nil{
+		return err
+	}
+	user := expandUser(src.user)
+	pass,ok := user.Password()
+	if !ok || pass==""{
+		return err
+	}
+	forms := []string{pass,url.QueryEscape(pass),url.PathEscape(pass)}
+	//the userinfo escape some characters other than query and path
+	if info:=user.String();strings.Contains(info,":"){
+		forms = append(forms,info[strings.Index(info,":")+1:])
+	}
+	//the longer first, the password may be a part of its escaped form
+	sort.Slice(forms, func(i, j int) bool {
+		return len(forms[i])>len(forms[j])
+	})
+	msg := err.Error()
+	for _,f:=range forms{
+		msg = strings.ReplaceAll(msg,f,"xxxxx")
+	}
+	if msg==err.Error(){
+		return err
+	}
+	return errors.New(msg)
+}
+
+//AddBackup append a backup source, user replace the credential in url if
+//not nil. It must be called before the stream start
+func (s *Stream) AddBackup(from string,user *url.Userinfo) error {
+	src,err := parseSource(from)
+	if err!= nil{
+		return err
+	}
+	if user!= nil{
+		src.user = user
+	}
+	s.backups = append(s.backups,src)
+	return nil
+}
+
+//Backups return the backup urls without credentials
+func (s *Stream) Backups() []string {
+	var (
+		list []string
+	)
+	for _,src:=range s.backups{
+		list = append(list,src.remote.String())
+	}
+	return list
+}
+
+//sourceAt return the source of index, 0 is the primary
+func (s *Stream) sourceAt(idx int) *source {
+	if idx==0{
+		return &source{remote:s.remote,user:s.user}
+	}
+	return s.backups[idx-1]
+}
+
+func (s *Stream) hasPending() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pending!= nil
+}
+
+//probePrimary dial the primary while the backup is read, once the primary
+//return its streams, it is kept as pending and the backup is closed
+func (s *Stream) probePrimary(stop <-chan struct{},backup av.DemuxCloser) {
+	var (
+		interval = s.srcconf.Failover
+	)
+	if interval<failbackMin{
+		interval = failbackMin
+	}
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+		cli,err := s.dial(s.sourceAt(0))
+		if err!= nil{
+			continue
+		}
+		if _,err = cli.Streams();err!= nil{
+			cli.Close()
+			continue
+		}
+		s.mu.Lock()
+		select {
+		case <-stop:
+			cli.Close()
+		case <-s.stopch:
+			cli.Close()
+		default:
+			s.pending = cli
+			backup.Close()
+		}
+		s.mu.Unlock()
+		return
+	}
+}
+
+//notifySwitch must be called with s.mu held
+func (s *Stream) notifySwitch(src *source) {
+	if s.hook==nil{
+		return
+	}
+	s.hook.Hook(&HookEvent{
+		Type:HookSwitch,
+		Stream:s.Id(),
+		Url:src.remote.String(),
+		At:time.Now(),
+	})
+}
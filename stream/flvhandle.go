@@ -0,0 +1,241 @@
+package stream
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/format/flv"
+)
+
+const (
+	flvIndexHtmlTmp =`
+<html>
+<head>
+	<title>rtspmux</title>
+	<meta charset="utf-8">
+	<script src="https://unpkg.com/flv.js/dist/flv.min.js"></script>
+</head>
+<body>
+{{- range $s := $.streams -}}
+	<video id="{{- $s.Id }}" controls muted width="640" height="264"></video>
+	<script type="text/javascript">
+		if (flvjs.isSupported()) {
+			var p{{ $s.Id }} = flvjs.createPlayer({type: 'flv', isLive: true, url: '{{- $s.Path}}'});
+			p{{ $s.Id }}.attachMediaElement(document.getElementById('{{- $s.Id }}'));
+			p{{ $s.Id }}.load();
+			p{{ $s.Id }}.play();
+		}
+	</script>
+{{- end }}
+</body>
+</html>
+`
+)
+
+type FlvHandler struct {
+	sts map[string]*Stream
+	mu sync.RWMutex
+	prefix string
+}
+
+func NewFlvHandler(preroute string) Handler {
+	return &FlvHandler{
+		sts:make(map[string]*Stream),
+		prefix:preroute,
+	}
+}
+
+func (h *FlvHandler) AddStreams(s *Stream) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _,ok:=h.sts[s.Id()];ok{
+		return ErrHadAdd
+	}
+	h.sts[s.Id()]=s
+	return nil
+}
+
+func (h *FlvHandler) DelStreams(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.sts,id)
+}
+
+//UpdateStreams do nothing since flv has no hls setting
+func (h *FlvHandler) UpdateStreams(s *Stream) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if _,ok:=h.sts[s.Id()];!ok{
+		return ErrNotAdd
+	}
+	return nil
+}
+
+//handle {id}.flv request, the response is chunked until client or stream gone
+func (h *FlvHandler) HandlerStream(w http.ResponseWriter,req *http.Request) {
+	var (
+		name = path.Base(path.Clean(req.URL.Path))
+		st *Stream
+		ok bool
+	)
+	if path.Ext(name)!=".flv"{
+		http.NotFound(w,req)
+		return
+	}
+	h.mu.RLock()
+	st,ok = h.sts[strings.TrimSuffix(name,".flv")]
+	h.mu.RUnlock()
+	if !ok{
+		http.NotFound(w,req)
+		return
+	}
+	flusher,ok := w.(http.Flusher)
+	if !ok{
+		http.Error(w,"streaming unsupported",http.StatusInternalServerError)
+		return
+	}
+
+	st.Touch()
+	cursor,err := st.Cursor(req.Context().Done())
+	if err!= nil{
+		http.Error(w,err.Error(),http.StatusServiceUnavailable)
+		return
+	}
+	cds,err := cursor.Streams()
+	if err!= nil{
+		http.Error(w,err.Error(),http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "video/x-flv")
+	w.WriteHeader(http.StatusOK)
+
+	fw := &flvWriter{w:w,f:flusher}
+	mux := flv.NewMuxerWriteFlusher(fw)
+	if err = mux.WriteHeader(cds);err!= nil{
+		return
+	}
+	fw.Flush()
+	err = copyLive(req.Context().Done(),st,cursor,mux,fw.Flush)
+	fmt.Println("flv stream",st.Path(),"client",req.RemoteAddr,"closed",err)
+}
+
+func (h *FlvHandler) Stop(){
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for id:=range h.sts{
+		delete(h.sts,id)
+	}
+}
+
+//handle index html
+func (h *FlvHandler) HandlerIndex(w http.ResponseWriter,req *http.Request) {
+	var (
+		data = make(map[string]interface{})
+		videos []*videoHtml
+		tmpl,_ = template.New("").Parse(flvIndexHtmlTmp)
+	)
+
+	h.mu.RLock()
+	for _,v:=range h.sts{
+		videos=append(videos,&videoHtml{
+			Id:v.Id(),
+			Path:path.Join(h.prefix,fmt.Sprintf("%s.flv",v.Id())),
+		})
+	}
+	h.mu.RUnlock()
+	data["streams"]=videos
+
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	tmpl.Execute(buf,data)
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(buf.Bytes())))
+	w.Write(buf.Bytes())
+	bufPool.Put(buf)
+}
+
+//copyLive write packets from cursor into mux, timestamps are rebased to the
+//first packet so players start at zero. When the source reconnect or switch
+//the timestamps start over, they are rebased to continue one frame after the
+//last written. flush is called after every packet.
+func copyLive(stopch <-chan struct{},s *Stream,cursor av.PacketReader,mux av.PacketWriter,flush func() error) error {
+	var (
+		base,offset time.Duration
+		last,frame time.Duration
+		//prevs is the last timestamp of every stream from source
+		prevs = make(map[int8]time.Duration)
+		started bool
+		touched time.Time
+	)
+	for {
+		select {
+		case <-stopch:
+			return nil
+		case <-s.stopch:
+			return nil
+		default:
+		}
+		pkt,err := cursor.ReadPacket()
+		if err!= nil{
+			return err
+		}
+		prev,ok := prevs[pkt.Idx]
+		switch {
+		case !started:
+			base = pkt.Time
+			started = true
+		case ok && pkt.Time<prev:
+			base,offset = pkt.Time,last+frame
+			prevs = make(map[int8]time.Duration)
+		case ok && pkt.Time>prev:
+			frame = pkt.Time-prev
+		}
+		prevs[pkt.Idx] = pkt.Time
+		//keep the on demand source while playing
+		if now:=time.Now();now.Sub(touched)>=time.Second{
+			s.Touch()
+			touched = now
+		}
+		pkt.Time -= base
+		if pkt.Time<0{
+			pkt.Time = 0
+		}
+		pkt.Time += offset
+		if pkt.Time>last{
+			last = pkt.Time
+		}
+		if err = mux.WritePacket(pkt);err!= nil{
+			return err
+		}
+		if err = flush();err!= nil{
+			return err
+		}
+	}
+}
+
+type flvWriter struct {
+	w http.ResponseWriter
+	f http.Flusher
+}
+
+func (fw *flvWriter) Write(p []byte) (int,error) {
+	return fw.w.Write(p)
+}
+
+func (fw *flvWriter) Flush() error {
+	fw.f.Flush()
+	return nil
+}
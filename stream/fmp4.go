@@ -0,0 +1,406 @@
+package stream
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/nareix/joy4/format/mp4/mp4io"
+	"github.com/nareix/joy4/utils/bits/pio"
+)
+
+const (
+	fmp4VideoTimeScale = 90000
+
+	sampleFlagSync = 0x02000000
+	sampleFlagNonSync = 0x01010000
+)
+
+//fmp4Muxer write fragmented mp4, WriteInit write ftyp and moov,
+//and Flush write one moof and mdat for the packets buffered since last Flush
+type fmp4Muxer struct {
+	tracks []*fmp4Track
+	seq uint32
+}
+
+type fmp4Track struct {
+	cd av.CodecData
+	id uint32
+	timescale int64
+	samples []av.Packet
+	//lastdur is the duration of last flushed sample, used when the end is unknown
+	lastdur int64
+}
+
+func newFmp4Muxer(cds []av.CodecData) (*fmp4Muxer,error) {
+	m := &fmp4Muxer{}
+	for i,cd:=range cds{
+		t := &fmp4Track{
+			cd:cd,
+			id:uint32(i+1),
+		}
+		switch cd.Type() {
+		case av.H264:
+			t.timescale = fmp4VideoTimeScale
+		case av.AAC:
+			t.timescale = int64(cd.(av.AudioCodecData).SampleRate())
+		default:
+			return nil,fmt.Errorf("fmp4: codec type=%v is not supported",cd.Type())
+		}
+		m.tracks = append(m.tracks,t)
+	}
+	return m,nil
+}
+
+func (t *fmp4Track) ts(tm time.Duration) int64 {
+	return int64(tm*time.Duration(t.timescale)/time.Second)
+}
+
+//WriteInit write the init segment, ftyp and moov without samples
+func (m *fmp4Muxer) WriteInit(w io.Writer) error {
+	var (
+		ftyp = []byte{
+			0,0,0,0x1c,'f','t','y','p',
+			'i','s','o','6',0,0,0,1,
+			'i','s','o','6','c','m','f','c','m','p','4','1',
+		}
+		mvex = &mp4io.MovieExtend{}
+	)
+	moov := &mp4io.Movie{
+		Header:&mp4io.MovieHeader{
+			TimeScale:1000,
+			PreferredRate:1,
+			PreferredVolume:1,
+			Matrix:[9]int32{0x10000,0,0,0,0x10000,0,0,0,0x40000000},
+			NextTrackId:int32(len(m.tracks)+1),
+		},
+	}
+	for _,t:=range m.tracks{
+		trak,err := t.trackAtom()
+		if err!= nil{
+			return err
+		}
+		moov.Tracks = append(moov.Tracks,trak)
+		mvex.Tracks = append(mvex.Tracks,&mp4io.TrackExtend{
+			TrackId:t.id,
+			DefaultSampleDescIdx:1,
+		})
+	}
+	//mvex is placed after trak boxes
+	moov.Unknowns = append(moov.Unknowns,mvex)
+
+	b := make([]byte,moov.Len())
+	moov.Marshal(b)
+	if _,err := w.Write(ftyp);err!= nil{
+		return err
+	}
+	_,err := w.Write(b)
+	return err
+}
+
+func (t *fmp4Track) trackAtom() (*mp4io.Track,error) {
+	sample := &mp4io.SampleTable{
+		SampleDesc:&mp4io.SampleDesc{},
+		TimeToSample:&mp4io.TimeToSample{},
+		SampleToChunk:&mp4io.SampleToChunk{},
+		SampleSize:&mp4io.SampleSize{},
+		ChunkOffset:&mp4io.ChunkOffset{},
+	}
+	trak := &mp4io.Track{
+		Header:&mp4io.TrackHeader{
+			TrackId:int32(t.id),
+			Flags:0x0003,
+			Matrix:[9]int32{0x10000,0,0,0,0x10000,0,0,0,0x40000000},
+		},
+		Media:&mp4io.Media{
+			Header:&mp4io.MediaHeader{
+				TimeScale:int32(t.timescale),
+				Language:21956,
+			},
+			Info:&mp4io.MediaInfo{
+				Sample:sample,
+				Data:&mp4io.DataInfo{
+					Refer:&mp4io.DataRefer{
+						Url:&mp4io.DataReferUrl{
+							Flags:0x000001,
+						},
+					},
+				},
+			},
+		},
+	}
+	switch t.cd.Type() {
+	case av.H264:
+		codec := t.cd.(h264parser.CodecData)
+		sample.SampleDesc.AVC1Desc = &mp4io.AVC1Desc{
+			DataRefIdx:1,
+			HorizontalResolution:72,
+			VorizontalResolution:72,
+			Width:int16(codec.Width()),
+			Height:int16(codec.Height()),
+			FrameCount:1,
+			Depth:24,
+			ColorTableId:-1,
+			Conf:&mp4io.AVC1Conf{Data:codec.AVCDecoderConfRecordBytes()},
+		}
+		trak.Media.Handler = &mp4io.HandlerRefer{
+			SubType:[4]byte{'v','i','d','e'},
+			Name:[]byte("Video Media Handler"),
+		}
+		trak.Media.Info.Video = &mp4io.VideoMediaInfo{
+			Flags:0x000001,
+		}
+		trak.Header.TrackWidth = float64(codec.Width())
+		trak.Header.TrackHeight = float64(codec.Height())
+	case av.AAC:
+		codec := t.cd.(aacparser.CodecData)
+		sample.SampleDesc.MP4ADesc = &mp4io.MP4ADesc{
+			DataRefIdx:1,
+			NumberOfChannels:int16(codec.ChannelLayout().Count()),
+			SampleSize:int16(codec.SampleFormat().BytesPerSample()),
+			SampleRate:float64(codec.SampleRate()),
+			Conf:&mp4io.ElemStreamDesc{
+				DecConfig:codec.MPEG4AudioConfigBytes(),
+			},
+		}
+		trak.Header.Volume = 1
+		trak.Header.AlternateGroup = 1
+		trak.Media.Handler = &mp4io.HandlerRefer{
+			SubType:[4]byte{'s','o','u','n'},
+			Name:[]byte("Sound Handler"),
+		}
+		trak.Media.Info.Sound = &mp4io.SoundMediaInfo{}
+	default:
+		return nil,fmt.Errorf("fmp4: codec type=%v is not supported",t.cd.Type())
+	}
+	return trak,nil
+}
+
+//WritePacket buffer the packet until next Flush
+func (m *fmp4Muxer) WritePacket(pkt av.Packet) error {
+	if int(pkt.Idx)>=len(m.tracks){
+		return fmt.Errorf("fmp4: packet index %d out of range",pkt.Idx)
+	}
+	t := m.tracks[pkt.Idx]
+	t.samples = append(t.samples,pkt)
+	return nil
+}
+
+//Buffered report whether there are packets not flushed
+func (m *fmp4Muxer) Buffered() bool {
+	for _,t:=range m.tracks{
+		if len(t.samples)>0{
+			return true
+		}
+	}
+	return false
+}
+
+//Flush write buffered packets as one fragment, end is the time where the
+//fragment stop, used as the duration of the last sample
+func (m *fmp4Muxer) Flush(w io.Writer,end time.Duration) error {
+	var (
+		moof []byte
+		mdatlen int
+		trafs []*fmp4Track
+	)
+	for _,t:=range m.tracks{
+		if len(t.samples)>0{
+			trafs = append(trafs,t)
+			for _,pkt:=range t.samples{
+				mdatlen += len(pkt.Data)
+			}
+		}
+	}
+	if len(trafs)==0{
+		return nil
+	}
+	m.seq++
+
+	//moof: mfhd + traf(tfhd,tfdt,trun) for every track
+	mooflen := 8 + 16
+	for _,t:=range trafs{
+		mooflen += 8 + 16 + 20 + 20 + 16*len(t.samples)
+	}
+	moof = make([]byte,mooflen,mooflen+8)
+	n := 0
+	n += putBoxHeader(moof[n:],mooflen,"moof")
+	n += putBoxHeader(moof[n:],16,"mfhd")
+	pio.PutU32BE(moof[n:],0)
+	pio.PutU32BE(moof[n+4:],m.seq)
+	n += 8
+
+	dataoff := mooflen + 8
+	for _,t:=range trafs{
+		trunlen := 20 + 16*len(t.samples)
+		n += putBoxHeader(moof[n:],8+16+20+trunlen,"traf")
+		n += putBoxHeader(moof[n:],16,"tfhd")
+		pio.PutU32BE(moof[n:],mp4io.TFHD_DEFAULT_BASE_IS_MOOF)
+		pio.PutU32BE(moof[n+4:],t.id)
+		n += 8
+		n += putBoxHeader(moof[n:],20,"tfdt")
+		pio.PutU32BE(moof[n:],1<<24)
+		pio.PutU64BE(moof[n+4:],uint64(t.ts(t.samples[0].Time)))
+		n += 12
+		n += putBoxHeader(moof[n:],trunlen,"trun")
+		pio.PutU32BE(moof[n:],mp4io.TRUN_DATA_OFFSET|mp4io.TRUN_SAMPLE_DURATION|
+			mp4io.TRUN_SAMPLE_SIZE|mp4io.TRUN_SAMPLE_FLAGS|mp4io.TRUN_SAMPLE_CTS)
+		pio.PutU32BE(moof[n+4:],uint32(len(t.samples)))
+		pio.PutU32BE(moof[n+8:],uint32(dataoff))
+		n += 12
+		for i,pkt:=range t.samples{
+			var (
+				dur int64
+				flags uint32 = sampleFlagSync
+			)
+			if i+1<len(t.samples){
+				dur = t.ts(t.samples[i+1].Time)-t.ts(pkt.Time)
+			}else if end>pkt.Time{
+				dur = t.ts(end)-t.ts(pkt.Time)
+			}else{
+				dur = t.lastdur
+			}
+			if dur<0{
+				dur = 0
+			}
+			t.lastdur = dur
+			if t.cd.Type().IsVideo() && !pkt.IsKeyFrame{
+				flags = sampleFlagNonSync
+			}
+			pio.PutU32BE(moof[n:],uint32(dur))
+			pio.PutU32BE(moof[n+4:],uint32(len(pkt.Data)))
+			pio.PutU32BE(moof[n+8:],flags)
+			pio.PutU32BE(moof[n+12:],uint32(t.ts(pkt.CompositionTime)))
+			n += 16
+			dataoff += len(pkt.Data)
+		}
+	}
+
+	moof = moof[:n+8]
+	putBoxHeader(moof[n:],8+mdatlen,"mdat")
+	if _,err := w.Write(moof);err!= nil{
+		return err
+	}
+	for _,t:=range trafs{
+		for _,pkt:=range t.samples{
+			if _,err := w.Write(pkt.Data);err!= nil{
+				return err
+			}
+		}
+		t.samples = t.samples[:0]
+	}
+	return nil
+}
+
+func putBoxHeader(b []byte,size int,tag string) int {
+	pio.PutU32BE(b,uint32(size))
+	copy(b[4:8],tag)
+	return 8
+}
+
+//fmp4SegmentMuxer write every hls part as one fragment
+type fmp4SegmentMuxer struct {
+	mux *fmp4Muxer
+	w io.Writer
+}
+
+func (m *fmp4SegmentMuxer) header(cds []av.CodecData) ([]byte,error) {
+	var (
+		buf bytes.Buffer
+		err error
+	)
+	m.mux,err = newFmp4Muxer(cds)
+	if err!= nil{
+		return nil,err
+	}
+	if err = m.mux.WriteInit(&buf);err!= nil{
+		return nil,err
+	}
+	return buf.Bytes(),nil
+}
+
+func (m *fmp4SegmentMuxer) begin(w io.Writer) error {
+	m.w = w
+	return nil
+}
+
+func (m *fmp4SegmentMuxer) writePacket(pkt av.Packet) error {
+	return m.mux.WritePacket(pkt)
+}
+
+func (m *fmp4SegmentMuxer) endPart(end time.Duration) error {
+	return m.mux.Flush(m.w,end)
+}
+
+//fmp4FileMuxer write a fragmented mp4 file, a fragment is flushed at the
+//first key frame after fragtime, so the file stays playable up to the
+//last flushed fragment when the process crash
+type fmp4FileMuxer struct {
+	w io.Writer
+	mux *fmp4Muxer
+	fragtime time.Duration
+	//idx is the stream used to decide where to flush, video if there is
+	idx int8
+	video bool
+	//start is the time of the first packet buffered
+	start time.Duration
+}
+
+func newFmp4FileMuxer(w io.Writer,fragtime time.Duration) *fmp4FileMuxer {
+	return &fmp4FileMuxer{
+		w:w,
+		fragtime:fragtime,
+	}
+}
+
+func (m *fmp4FileMuxer) WriteHeader(cds []av.CodecData) error {
+	var (
+		err error
+	)
+	m.mux,err = newFmp4Muxer(cds)
+	if err!= nil{
+		return err
+	}
+	for i,cd:=range cds{
+		if cd.Type().IsVideo(){
+			m.idx,m.video = int8(i),true
+			break
+		}
+	}
+	return m.mux.WriteInit(m.w)
+}
+
+func (m *fmp4FileMuxer) WritePacket(pkt av.Packet) error {
+	if m.mux.Buffered(){
+		elapsed := pkt.Time-m.start
+		key := pkt.Idx==m.idx && (pkt.IsKeyFrame || !m.video)
+		if (key && elapsed>=m.fragtime) || elapsed>=m.fragtime*maxSegmentFactor{
+			if err:=m.flush(pkt.Time);err!= nil{
+				return err
+			}
+		}
+	}
+	if !m.mux.Buffered(){
+		m.start = pkt.Time
+	}
+	return m.mux.WritePacket(pkt)
+}
+
+func (m *fmp4FileMuxer) WriteTrailer() error {
+	return m.flush(0)
+}
+
+func (m *fmp4FileMuxer) flush(end time.Duration) error {
+	if err:=m.mux.Flush(m.w,end);err!= nil{
+		return err
+	}
+	//the fragment is on disk even if power is lost
+	if f,ok:=m.w.(interface{ Sync() error });ok{
+		return f.Sync()
+	}
+	return nil
+}
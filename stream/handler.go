@@ -5,6 +5,7 @@ import (
 	"errors"
 	"bytes"
 	"sync"
+	"time"
 )
 var (
 	ErrHadAdd = errors.New("had add")
@@ -19,6 +20,8 @@ var (
 type Handler interface {
 	AddStreams(s *Stream) error
 	DelStreams(id string)
+	//UpdateStreams apply the changed hls setting of added stream in place
+	UpdateStreams(s *Stream) error
 	HandlerStream(w http.ResponseWriter,req *http.Request)
 	HandlerIndex(w http.ResponseWriter,req *http.Request)
 	Stop()
@@ -27,5 +30,12 @@ type Handler interface {
 
 type Saver interface {
 	Start(s *Stream)
+	//Event record the stream from pre before now to post after now, negative
+	//pre and zero post are the default
+	Event(s *Stream,name string,pre,post time.Duration) (*Event,error)
+	//Stats return the recording counters by stream id
+	Stats() map[string]RecordStats
+	//Reload replace the config without stopping the recordings
+	Reload(c *Saveconf) error
 	Stop()
 }
@@ -6,6 +6,9 @@ import (
 	"net/http"
 	"time"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
 	"strings"
 	"strconv"
 	"path"
@@ -22,21 +25,21 @@ const (
 <head>
 	<title>rtspmux</title>
 	<meta charset="utf-8">
-	<link href="https://unpkg.com/video.js/dist/video-js.css" rel="stylesheet">
-	<script src="https://unpkg.com/video.js/dist/video.js"></script>
-	<script src="https://unpkg.com/videojs-contrib-hls/dist/videojs-contrib-hls.js"></script>
+	<script src="https://unpkg.com/hls.js/dist/hls.min.js"></script>
 </head>
 <body>
 {{- range $s := $.streams -}}
-	<video id="{{- $s.Id }}" class="video-js vjs-default-skin" controls preload="none" width="640" height="264" data-setup="{}">
-		<source src="{{- $s.Path}}" type='application/x-mpegURL'>
-	</video>
+	<video id="{{- $s.Id }}" controls muted width="640" height="264"></video>
 	<script type="text/javascript">
-		var {{- $s.Id -}}j=videojs('{{- $s.Id }}');
-		videojs("{{- $s.Id }}").ready(function(){
-			var player = this;
-			player.play();
-		});
+		var v{{ $s.Id }} = document.getElementById('{{- $s.Id }}');
+		if (Hls.isSupported()) {
+			var h{{ $s.Id }} = new Hls({lowLatencyMode: true});
+			h{{ $s.Id }}.loadSource('{{- $s.Path}}');
+			h{{ $s.Id }}.attachMedia(v{{ $s.Id }});
+		} else if (v{{ $s.Id }}.canPlayType('application/vnd.apple.mpegurl')) {
+			v{{ $s.Id }}.src = '{{- $s.Path}}';
+		}
+		v{{ $s.Id }}.play();
 	</script>
 {{- end }}
 </body>
@@ -50,9 +53,13 @@ type videoHtml struct {
 }
 
 var (
+	//default hls setting, 3 segments of 10s in playlist, twice are kept
 	tslen = 3
-	Tslength = tslen * 2
 	tstime = time.Second * 10
+	//parttime is the target duration of LL-HLS partial segment
+	parttime = time.Millisecond * 500
+	//fragment is cut without key frame when it is longer than fragtime*maxSegmentFactor
+	maxSegmentFactor time.Duration = 3
 	tselepool = sync.Pool{
 		New: func() interface{} {
 			return &tsele{
@@ -61,7 +68,7 @@ var (
 		}}
 	tsmuxpool = sync.Pool{
 		New: func() interface{} {
-			return new(ts.Muxer)
+			return ts.NewMuxer(ioutil.Discard)
 		}}
 
 	crossdomainxml = []byte(`<?xml version="1.0" ?>
@@ -71,6 +78,67 @@ var (
 </cross-domain-policy>`)
 )
 
+type SegmentFormat int
+
+const (
+	TsSegment SegmentFormat = iota
+	//Fmp4Segment is CMAF segment with EXT-X-MAP init section
+	Fmp4Segment
+)
+
+//HlsConf is the hls setting of a stream, zero value means default
+type HlsConf struct {
+	Segment SegmentFormat
+	//Duration is the target duration of segment
+	Duration time.Duration
+	//Length is the number of segments in playlist
+	Length int
+	//Retain is the number of segments kept in memory, at least Length+1
+	Retain int
+	//Dvr keep segments on disk for timeshift, nil is disabled
+	Dvr *DvrConf
+}
+
+func (c HlsConf) withDefault() HlsConf {
+	if c.Duration<=0{
+		c.Duration = tstime
+	}
+	if c.Length<=0{
+		c.Length = tslen
+	}
+	if c.Retain<=0{
+		c.Retain = c.Length*2
+	}
+	if c.Retain<c.Length+1{
+		c.Retain = c.Length+1
+	}
+	return c
+}
+
+func ParseSegmentFormat(s string) (SegmentFormat,error) {
+	switch s {
+	case "","ts":
+		return TsSegment,nil
+	case "fmp4","cmaf":
+		return Fmp4Segment,nil
+	}
+	return TsSegment,fmt.Errorf("segment format %s not support",s)
+}
+
+func (f SegmentFormat) String() string {
+	if f==Fmp4Segment{
+		return "fmp4"
+	}
+	return "ts"
+}
+
+func (f SegmentFormat) ext() string {
+	if f==Fmp4Segment{
+		return ".m4s"
+	}
+	return ".ts"
+}
+
 type HlsHandler struct {
 	sts map[string]*hls
 	mu sync.RWMutex
@@ -79,12 +147,29 @@ type HlsHandler struct {
 
 type hls struct {
 	s *Stream
+	conf HlsConf
 	mu sync.RWMutex
 	tslist []*tsele
+	//inits is the fmp4 init section of segments, by initid
+	inits map[int][]byte
+	initid int
+	//periods is the first segment of every init section, dash period start at it
+	periods map[int]dashPeriod
+	//track is the only stream index segmented, -1 is all streams
+	track int8
+	cds []av.CodecData
+	dvr *dvr
 
-	m3uid int
-	beginIndex int
-	hls *HlsHandler
+	//seq is the media sequence number of the segment being written
+	seq int
+	//base is the first media sequence number, it continue from the replaced hls
+	base int
+	//discseq is the discontinuity sequence of the first segment in playlist
+	discseq int
+	//target is Duration rounded up to seconds, no segment is longer than it
+	target time.Duration
+	//notify is closed and renewed when a part or segment is completed
+	notify chan struct{}
 	stopch chan struct{}
 }
 
@@ -104,20 +189,50 @@ func (h *HlsHandler) DelStreams(id string) {
 	defer h.mu.Unlock()
 	if _,ok:=h.sts[id];ok{
 		h.sts[id].Stop()
+		delete(h.sts,id)
 	}
 	return
 }
 
-//handle m3u8(m3u),ts request
+//UpdateStreams apply the hls setting of stream to the running hls, the
+//segments, media sequence and dvr are kept. The segment format and target
+//duration can not be changed in place, the hls is replaced and the media
+//sequence continue
+func (h *HlsHandler) UpdateStreams(s *Stream) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	old,ok := h.sts[s.Id()]
+	if !ok{
+		return ErrNotAdd
+	}
+	conf := s.HlsConf().withDefault()
+	if old.reconf(conf){
+		return nil
+	}
+	nh := newHls(s)
+	nh.resume(old)
+	old.Stop()
+	h.sts[s.Id()]=nh
+	nh.Start()
+	return nil
+}
+
+//handle {id}/{name}.m3u8, {id}/{msn}.ts request, and {id}/dvr.m3u8 with
+//the segments on disk under {id}/dvr/
 func (h *HlsHandler) HandlerStream(w http.ResponseWriter,req *http.Request) {
 
 	var (
-		r = path.Clean(req.URL.Path)
+		r = strings.TrimPrefix(path.Clean(req.URL.Path),h.prefix)
+		names = strings.Split(strings.Trim(r,"/"),"/")
 		indexhls *hls
 		ok bool
 	)
-	dir,name := path.Split(r)
-	streamid := path.Base(dir)
+	if len(names)<2{
+		http.NotFound(w,req)
+		return
+	}
+	streamid,name := names[0],names[len(names)-1]
+	dir := path.Join(h.prefix,streamid)
 	h.mu.RLock()
 	indexhls,ok =h.sts[streamid]
 	if !ok{
@@ -126,35 +241,73 @@ func (h *HlsHandler) HandlerStream(w http.ResponseWriter,req *http.Request) {
 		return
 	}
 	h.mu.RUnlock()
+	indexhls.s.stats.request()
+	//the on demand source is dialed by the first request
+	pulled := indexhls.s.Touch()
 
 	if name == "crossdomain.xml" {
 		w.Header().Set("Content-Type", "application/xml")
 		w.Write(crossdomainxml)
 		return
 	}
+	switch {
+	case len(names)==2 && name=="dvr.m3u8":
+		indexhls.serveDvrM3u8(w,req,path.Join(dir,"dvr"))
+		return
+	case len(names)==3 && names[1]=="dvr":
+		indexhls.serveDvr(w,req,name)
+		return
+	case len(names)!=2:
+		http.NotFound(w,req)
+		return
+	}
 
 	switch path.Ext(name){
 	case ".m3u8":
-		bs := indexhls.M3u8(dir)
-		_,err:=w.Write(bs)
-
-		if err!= nil {
-			http.Error(w,err.Error(),http.StatusInternalServerError)
+		msn,part,err := blockParam(req)
+		if err!= nil{
+			http.Error(w,err.Error(),http.StatusBadRequest)
 			return
 		}
+		if pulled && msn<0{
+			indexhls.waitSource(req.Context().Done())
+		}
+		if msn>=0{
+			code := indexhls.waitPlaylist(req.Context().Done(),msn,part)
+			if code!=http.StatusOK{
+				http.Error(w,http.StatusText(code),code)
+				return
+			}
+		}
+		bs := withToken(req,indexhls.M3u8(dir))
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Cache-Control", "no-cache")
 		w.Header().Set("Content-Type", "application/x-mpegURL")
 		w.Header().Set("Content-Length", strconv.Itoa(len(bs)))
+		w.Write(bs)
 
-	case ".ts":
-		bs,err:=indexhls.Ts(name)
+	case ".ts",".m4s":
+		bs,err:=indexhls.Ts(req.Context().Done(),name)
 		if err!= nil {
-			http.Error(w,err.Error(),http.StatusBadRequest)
+			http.Error(w,err.Error(),http.StatusNotFound)
 			return
 		}
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Content-Type", "video/mp2ts")
+		if path.Ext(name)==".ts"{
+			w.Header().Set("Content-Type", "video/mp2ts")
+		}else{
+			w.Header().Set("Content-Type", "video/iso.segment")
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(bs)))
+		w.Write(bs)
+	case ".mp4":
+		bs,err:=indexhls.Init(name)
+		if err!= nil {
+			http.Error(w,err.Error(),http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Content-Type", "video/mp4")
 		w.Header().Set("Content-Length", strconv.Itoa(len(bs)))
 		w.Write(bs)
 	default:
@@ -163,6 +316,84 @@ func (h *HlsHandler) HandlerStream(w http.ResponseWriter,req *http.Request) {
 
 }
 
+//serveDvrM3u8 handle dvr.m3u8?start={offset}, the segments are listed under preroute
+func (h *hls) serveDvrM3u8(w http.ResponseWriter,req *http.Request,preroute string) {
+	h.mu.RLock()
+	d := h.dvr
+	h.mu.RUnlock()
+	if d==nil{
+		http.NotFound(w,req)
+		return
+	}
+	bs,err := d.M3u8(preroute,req.URL.Query().Get("start"))
+	if err!= nil{
+		http.Error(w,err.Error(),http.StatusBadRequest)
+		return
+	}
+	bs = withToken(req,bs)
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "application/x-mpegURL")
+	w.Header().Set("Content-Length", strconv.Itoa(len(bs)))
+	w.Write(bs)
+}
+
+//serveDvr handle the segments and init sections on disk
+func (h *hls) serveDvr(w http.ResponseWriter,req *http.Request,name string) {
+	h.mu.RLock()
+	d := h.dvr
+	h.mu.RUnlock()
+	if d==nil{
+		http.NotFound(w,req)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	f,err := d.open(name)
+	if err!= nil{
+		http.NotFound(w,req)
+		return
+	}
+	defer f.Close()
+	info,err := f.Stat()
+	if err!= nil{
+		http.Error(w,err.Error(),http.StatusInternalServerError)
+		return
+	}
+	switch path.Ext(name) {
+	case ".ts":
+		w.Header().Set("Content-Type", "video/mp2ts")
+	case ".m4s":
+		w.Header().Set("Content-Type", "video/iso.segment")
+	}
+	http.ServeContent(w,req,name,info.ModTime(),f)
+}
+
+//blockParam parse _HLS_msn and _HLS_part, -1 means not set
+func blockParam(req *http.Request) (int,int,error) {
+	var (
+		msn = -1
+		part = -1
+		err error
+		query = req.URL.Query()
+	)
+	if v:=query.Get("_HLS_msn");v!=""{
+		msn,err = strconv.Atoi(v)
+		if err!= nil || msn<0{
+			return -1,-1,fmt.Errorf("invalid _HLS_msn %s",v)
+		}
+	}
+	if v:=query.Get("_HLS_part");v!=""{
+		if msn<0{
+			return -1,-1,fmt.Errorf("_HLS_part without _HLS_msn")
+		}
+		part,err = strconv.Atoi(v)
+		if err!= nil || part<0{
+			return -1,-1,fmt.Errorf("invalid _HLS_part %s",v)
+		}
+	}
+	return msn,part,nil
+}
+
 func (h *HlsHandler) Stop(){
 	h.mu.Lock()
 	defer h.mu.Unlock()
@@ -211,139 +442,690 @@ func NewHlsHandler(preroute string) Handler {
 }
 
 func newHls(s *Stream) *hls {
+	conf := s.HlsConf().withDefault()
 	h:= &hls{
 		s:s,
-		tslist:make([]*tsele,Tslength),
+		conf:conf,
+		tslist:make([]*tsele,conf.Retain),
+		inits:make(map[int][]byte),
+		periods:make(map[int]dashPeriod),
+		track:-1,
+		target:targetDuration(conf.Duration),
+		notify: make(chan struct{}),
 		stopch: make(chan struct{}),
 	}
-	for i:=0;i<Tslength;i++ {
+	for i:=range h.tslist {
 		h.tslist[i]=tselepool.Get().(*tsele)
+		h.tslist[i].reset(-1)
 	}
 	return h
 }
 
+//reconf apply the setting under lock, return false if the segment format or
+//the target duration changed. The newest segments are kept when Retain changed
+func (h *hls) reconf(c HlsConf) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if c.Segment!=h.conf.Segment || targetDuration(c.Duration)!=h.target{
+		return false
+	}
+	if c.Retain!=len(h.tslist){
+		h.resize(c.Retain)
+	}
+	h.conf.Duration = c.Duration
+	h.conf.Length = c.Length
+	h.conf.Retain = c.Retain
+	if h.track<0{
+		h.reconfDvr(c.Dvr)
+	}
+	h.conf.Dvr = c.Dvr
+	h.broadcast()
+	return true
+}
+
+//resize the ring of segments to n, must be called with h.mu held
+func (h *hls) resize(n int) {
+	list := make([]*tsele,n)
+	for _,seg:=range h.tslist{
+		if seg.seq>=0 && seg.seq>h.seq-n{
+			list[seg.seq%n] = seg
+		}else{
+			tselepool.Put(seg)
+		}
+	}
+	for i:=range list{
+		if list[i]==nil{
+			list[i] = tselepool.Get().(*tsele)
+			list[i].reset(-1)
+		}
+	}
+	h.tslist = list
+}
+
+//reconfDvr keep the dvr if the dir is not changed, the dvr of stream opened
+//by the replaced hls is reused, must be called with h.mu held
+func (h *hls) reconfDvr(c *DvrConf) {
+	switch {
+	case c==nil:
+		h.dvr = nil
+	case h.dvr!= nil && h.dvr.c.Dir==c.Dir:
+		h.dvr.reconf(*c)
+	default:
+		d,err := openDvr(*c,h.s.Id())
+		if err!= nil{
+			fmt.Println("hls stream",h.s.Path(),"dvr failed",err)
+			return
+		}
+		h.dvr = d
+	}
+}
+
+//resume continue the media sequence of old, the first segment is marked as
+//discontinuity
+func (h *hls) resume(old *hls) {
+	old.mu.RLock()
+	defer old.mu.RUnlock()
+	//the segment in writing of old is dropped
+	h.seq = old.seq+1
+	h.base = h.seq
+	h.discseq = old.discseq
+	for msn:=old.seq-old.conf.Length;msn<old.seq;msn++{
+		if msn<0{
+			continue
+		}
+		if seg:=old.tslist[msn%len(old.tslist)];seg.seq==msn && seg.discontinuity{
+			h.discseq++
+		}
+	}
+}
+
+//Stop the segmenter, the dvr is detached so nothing is saved after the hls
+//replaced it
 func (h *hls) Stop(){
 	close(h.stopch)
+	h.mu.Lock()
+	h.dvr = nil
+	h.mu.Unlock()
 }
 
 func (h *hls) releaseBuf() {
 	fmt.Println("stop hls",h.s.Path())
 	for _,v:=range h.tslist{
-		tselepool.Put(v.buf)
+		tselepool.Put(v)
 	}
 }
 
-//截取3段10s视频
+//Start read packets from the stream and cut them into segments and parts
 func (h *hls) Start() {
 	go func(){
 		var (
-			i int
-			count int
-			tsmux = tsmuxpool.Get().(*ts.Muxer)
+			mux segmentMuxer
 		)
-		for {
-			select {
-			case <-h.stopch:
-				h.releaseBuf()
-				return
-			}
-			i = i% (Tslength +1)
-			count = count % tslen
-			h.tslist[i].name=fmt.Sprintf("%d_%d.ts",time.Now().Unix(),i)
-			h.tslist[i].buf.Reset()
-			tsmux.SetWriter(h.tslist[i].buf)
-			err := h.s.WriteTo(tsmux,tstime)
-			if err!= nil{
-				fmt.Println("hls stream",h.s.Path(),"failed",err)
-				writeUntilSuccess(h.stopch,h.s,tsmux)
-			}
-			count++
-			i++
-			h.updateid(i,count)
+		defer h.releaseBuf()
+		if h.conf.Segment==Fmp4Segment{
+			mux = &fmp4SegmentMuxer{}
+		}else{
+			tsmux := tsmuxpool.Get().(*ts.Muxer)
+			defer tsmuxpool.Put(tsmux)
+			mux = &tsSegmentMuxer{mux:tsmux}
+		}
+		h.mu.Lock()
+		if h.conf.Dvr!= nil && h.track<0{
+			h.reconfDvr(h.conf.Dvr)
 		}
+		h.mu.Unlock()
+		cursor,err := h.s.Cursor(h.stopch)
+		if err!= nil{
+			fmt.Println("hls stream",h.s.Path(),"failed",err)
+			return
+		}
+		err = h.segment(cursor,mux)
+		fmt.Println("hls stream",h.s.Path(),"stopped",err)
 	}()
 }
 
-func writeUntilSuccess(stopch <-chan struct{},s *Stream,mux av.Muxer) {
+func (h *hls) segment(cursor av.Demuxer,mux segmentMuxer) error {
 	var (
-		mind = time.Second * 5
-		maxd = time.Minute * 5
+		sg = &segmenter{h:h,mux:mux,disc:h.base>0}
 	)
-	tmp := mind
+	cds,err := cursor.Streams()
+	if err!= nil{
+		return err
+	}
+	if err = sg.header(cds);err!= nil{
+		return err
+	}
 	for {
 		select {
-		case <-stopch:
-			return
-		case <-time.NewTimer(tmp).C:
+		case <-h.stopch:
+			return nil
+		default:
 		}
-
-		err := s.WriteTo(mux,tstime)
+		pkt,err := cursor.ReadPacket()
 		if err!= nil{
-			tmp = tmp * 2
-			if tmp>=maxd{
-				tmp = maxd
+			return err
+		}
+		//source reconnected, timestamps start over
+		if sg.seg!= nil && pkt.Time+time.Second<sg.last{
+			sg.closeSegment(sg.last+sg.frame)
+			if cds,err = cursor.Streams();err!= nil{
+				return err
 			}
-			fmt.Println("stream",s.Path(),"try next time",time.Now().Add(tmp))
-		}else{
-			fmt.Println("stream",s.Path(),"recovered!")
+			if err = sg.header(cds);err!= nil{
+				return err
+			}
+			sg.disc = true
+		}
+		if err = sg.writePacket(pkt);err!= nil{
+			return err
+		}
+	}
+}
+
+//segmentMuxer mux packets into the segment, which is ts or fmp4
+type segmentMuxer interface {
+	//header return the init section, nil if not needed
+	header(cds []av.CodecData) ([]byte,error)
+	begin(w io.Writer) error
+	writePacket(pkt av.Packet) error
+	endPart(end time.Duration) error
+}
+
+type tsSegmentMuxer struct {
+	mux *ts.Muxer
+}
+
+func (m *tsSegmentMuxer) header(cds []av.CodecData) ([]byte,error) {
+	//PAT/PMT is written at every segment start
+	m.mux.SetWriter(ioutil.Discard)
+	return nil,m.mux.WriteHeader(cds)
+}
+
+func (m *tsSegmentMuxer) begin(w io.Writer) error {
+	m.mux.SetWriter(w)
+	return m.mux.WritePATPMT()
+}
+
+func (m *tsSegmentMuxer) writePacket(pkt av.Packet) error {
+	return m.mux.WritePacket(pkt)
+}
+
+func (m *tsSegmentMuxer) endPart(end time.Duration) error {
+	return nil
+}
+
+//segmenter cut packets into parts of parttime, and segments at the first
+//key frame after Duration, or without key frame before it exceed target
+type segmenter struct {
+	h *hls
+	mux segmentMuxer
+	//idx is the stream used to decide where to cut, video if there is
+	idx int8
+	video bool
+
+	seg *tsele
+	disc bool
+	//dur is the Duration when the segment opened
+	dur time.Duration
+	//lead is the segmenter of video track in dash, it decide where to cut
+	lead *segmenter
+	segStart time.Duration
+	partStart time.Duration
+	partOff int
+	//partIdx is set after a packet of idx written into the part
+	partIdx bool
+	last time.Duration
+	frame time.Duration
+}
+
+func (sg *segmenter) header(cds []av.CodecData) error {
+	if track:=sg.h.track;track>=0{
+		if int(track)>=len(cds){
+			return fmt.Errorf("track %d not found",track)
+		}
+		cds = cds[track:track+1]
+	}
+	sg.h.mu.Lock()
+	sg.h.cds = cds
+	sg.h.mu.Unlock()
+	sg.idx = 0
+	sg.video = false
+	for i,cd:=range cds{
+		if cd.Type().IsVideo(){
+			sg.idx = int8(i)
+			sg.video = true
 			break
 		}
 	}
+	sg.frame = 0
+	init,err := sg.mux.header(cds)
+	if err!= nil{
+		return err
+	}
+	if init!= nil{
+		h := sg.h
+		h.mu.Lock()
+		h.initid++
+		h.inits[h.initid]=init
+		h.mu.Unlock()
+	}
+	return nil
 }
 
-func (h *hls) updateid(in int,count int) {
+func (sg *segmenter) writePacket(pkt av.Packet) error {
+	if track:=sg.h.track;track>=0{
+		if pkt.Idx!=track{
+			return nil
+		}
+		pkt.Idx = 0
+	}
+	if pkt.Idx == sg.idx{
+		//segment always start with key frame
+		key := !sg.video || pkt.IsKeyFrame
+		if sg.seg == nil{
+			if !key || !sg.follow(pkt.Time){
+				return nil
+			}
+			sg.openSegment(pkt.Time)
+		}else{
+			if pkt.Time>sg.last{
+				sg.frame = pkt.Time - sg.last
+			}
+			elapsed := pkt.Time-sg.segStart
+			if sg.cut(key,pkt.Time,elapsed){
+				//the gap of timestamps is clamped, the segment never exceed target
+				end := pkt.Time
+				if elapsed>sg.h.target{
+					end = sg.segStart+sg.h.target
+				}
+				sg.closeSegment(end)
+				sg.openSegment(pkt.Time)
+			}else if pkt.Time-sg.partStart+sg.frame > parttime{
+				sg.closePart(pkt.Time)
+			}
+		}
+		sg.last = pkt.Time
+		if !sg.partIdx{
+			sg.h.mu.Lock()
+			sg.seg.independent = pkt.IsKeyFrame
+			sg.h.mu.Unlock()
+		}
+		sg.partIdx = true
+	}
+	if sg.seg == nil{
+		return nil
+	}
+	return sg.mux.writePacket(pkt)
+}
+
+//follow return whether the segment can be opened at t, the lead must be
+//segmenting already
+func (sg *segmenter) follow(t time.Duration) bool {
+	return sg.lead==nil || (sg.lead.seg!= nil && t>=sg.lead.segStart)
+}
+
+//cut return whether the segment is cut before the packet of t. It is cut
+//at the cut of lead while the lead is receiving, otherwise at key frame
+//after Duration, and always before exceed target
+func (sg *segmenter) cut(key bool,t time.Duration,elapsed time.Duration) bool {
+	if l:=sg.lead;l!= nil && t<=l.last+time.Second{
+		return l.seg!= nil && l.segStart>sg.segStart && t>=l.segStart
+	}
+	if elapsed+sg.frame>sg.h.target{
+		return true
+	}
+	return key && elapsed>=sg.dur
+}
+
+func (sg *segmenter) openSegment(start time.Duration) {
+	h := sg.h
 	h.mu.Lock()
-	h.beginIndex = in
-	if count == tslen {
-		h.m3uid++
+	//the segment slide out of playlist
+	if old:=h.tslist[(h.seq+len(h.tslist)*2-h.conf.Length-1)%len(h.tslist)];old.seq>=0 && old.seq==h.seq-h.conf.Length-1 && old.discontinuity{
+		h.discseq++
+	}
+	sg.seg = h.tslist[h.seq%len(h.tslist)]
+	sg.seg.reset(h.seq)
+	sg.seg.discontinuity = sg.disc
+	sg.seg.initid = h.initid
+	sg.seg.start = start
+	sg.seg.at = time.Now()
+	sg.dur = h.conf.Duration
+	if _,ok:=h.periods[h.initid];!ok{
+		h.periods[h.initid] = dashPeriod{start:start,at:sg.seg.at}
+	}
+	//drop init sections no segment refer to
+	for id:=range h.inits{
+		used := false
+		for _,seg:=range h.tslist{
+			if seg.seq>=0 && seg.initid==id{
+				used = true
+				break
+			}
+		}
+		if !used{
+			delete(h.inits,id)
+			delete(h.periods,id)
+		}
 	}
 	h.mu.Unlock()
+	sg.disc = false
+	sg.segStart = start
+	sg.partStart = start
+	sg.partOff = 0
+	sg.partIdx = false
+	sg.mux.begin(&segWriter{h:h,seg:sg.seg})
 }
 
-func (h *hls) Ts(name string) ([]byte,error) {
-	id := strings.Split(name,"_")
-	if len(id)!= 2{
+func (sg *segmenter) closePart(end time.Duration) {
+	h := sg.h
+	if err:=sg.mux.endPart(end);err!= nil{
+		fmt.Println("hls stream",h.s.Path(),"part failed",err)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if sg.seg.buf.Len()==sg.partOff{
+		return
+	}
+	sg.seg.parts = append(sg.seg.parts,&tspart{
+		start:sg.partOff,
+		end:sg.seg.buf.Len(),
+		duration:end-sg.partStart,
+		independent:sg.seg.independent,
+	})
+	sg.seg.independent = false
+	sg.partOff = sg.seg.buf.Len()
+	sg.partIdx = false
+	sg.partStart = end
+	h.broadcast()
+}
+
+func (sg *segmenter) closeSegment(end time.Duration) {
+	if sg.seg == nil{
+		return
+	}
+	sg.closePart(end)
+	h := sg.h
+	h.mu.Lock()
+	sg.seg.duration = end-sg.segStart
+	sg.seg.done = true
+	h.seq++
+	h.broadcast()
+	//the tracks of dash are cut together, so only the first one is counted
+	if h.track<=0{
+		h.s.stats.segment()
+	}
+	d,init := h.dvr,h.inits[sg.seg.initid]
+	h.mu.Unlock()
+	//only the segmenter write the buffer, so it is safe to read without lock
+	if d!= nil{
+		err := d.save(h,&dvrSeg{
+			ext:h.conf.Segment.ext(),
+			duration:sg.seg.duration,
+			at:sg.seg.at,
+			discontinuity:sg.seg.discontinuity,
+		},sg.seg.buf.Bytes(),init)
+		if err!= nil{
+			fmt.Println("hls stream",h.s.Path(),"dvr save failed",err)
+		}
+	}
+	sg.seg = nil
+}
+
+//broadcast must be called with h.mu held
+func (h *hls) broadcast() {
+	close(h.notify)
+	h.notify = make(chan struct{})
+}
+
+//wait until ready return true, or timeout, caller must not hold h.mu
+func (h *hls) wait(cancel <-chan struct{},timeout time.Duration,ready func() bool) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		h.mu.RLock()
+		ok := ready()
+		notify := h.notify
+		h.mu.RUnlock()
+		if ok{
+			return true
+		}
+		select {
+		case <-notify:
+		case <-cancel:
+			return false
+		case <-h.stopch:
+			return false
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+//waitPlaylist block the playlist request until segment msn (or its part) is
+//available, return the http status code
+func (h *hls) waitPlaylist(cancel <-chan struct{},msn int,part int) int {
+	h.mu.RLock()
+	cur,dur := h.seq,h.conf.Duration
+	h.mu.RUnlock()
+	if msn > cur+2{
+		return http.StatusBadRequest
+	}
+	ok := h.wait(cancel,dur*3, func() bool {
+		if h.seq>msn{
+			return part<0 || h.seq>msn+1 || len(h.tslist[msn%len(h.tslist)].parts)>part
+		}
+		if h.seq<msn || part<0{
+			return false
+		}
+		return len(h.tslist[msn%len(h.tslist)].parts)>part
+	})
+	if !ok{
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusOK
+}
+
+//waitSource wait the first part after the on demand source is dialed, the
+//segments before the source was idle are stale. It wait one target duration
+//at most, so the players do not time out when the source is down
+func (h *hls) waitSource(cancel <-chan struct{}) {
+	h.mu.RLock()
+	msn,dur := h.seq,h.conf.Duration
+	if msn>h.base{
+		//the segment in writing is closed when the source reconnect
+		msn++
+	}
+	h.mu.RUnlock()
+	h.wait(cancel,dur, func() bool {
+		return h.seq>msn || (h.seq==msn && len(h.tslist[msn%len(h.tslist)].parts)>0)
+	})
+}
+
+//Ts return a copy of the segment named {msn}.ts or the part named {msn}_{part}.ts,
+//the extension is .m4s for fmp4 segment,
+//request for the next part of the current segment is blocked until it is ready
+func (h *hls) Ts(cancel <-chan struct{},name string) ([]byte,error) {
+	var (
+		msn int
+		part = -1
+		err error
+		id = strings.Split(strings.TrimSuffix(name,h.conf.Segment.ext()),"_")
+	)
+	if path.Ext(name)!=h.conf.Segment.ext(){
+		return nil,ErrNameIncorrect
+	}
+	if len(id)>2{
 		fmt.Println("name",name,"not")
 		return nil,ErrNameIncorrect
 	}
-	num,err := strconv.Atoi(id[1])
+	msn,err = strconv.Atoi(id[0])
 	if err!= nil{
-		fmt.Println("parse",id[1],"failed",err)
+		fmt.Println("parse",id[0],"failed",err)
 		return nil,err
 	}
-	return h.tslist[num].buf.Bytes(),nil
+	if msn<0{
+		return nil,ErrNameIncorrect
+	}
+	if len(id)==2{
+		part,err = strconv.Atoi(id[1])
+		if err!= nil{
+			fmt.Println("parse",id[1],"failed",err)
+			return nil,err
+		}
+		if part<0{
+			return nil,ErrNameIncorrect
+		}
+		h.mu.RLock()
+		hint := msn==h.seq && part==len(h.tslist[msn%len(h.tslist)].parts)
+		h.mu.RUnlock()
+		if hint{
+			h.wait(cancel,parttime*3, func() bool {
+				return h.seq!=msn || len(h.tslist[msn%len(h.tslist)].parts)>part
+			})
+		}
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	seg := h.tslist[msn%len(h.tslist)]
+	if seg.seq!=msn{
+		return nil,ErrNameIncorrect
+	}
+	if part<0{
+		if !seg.done{
+			return nil,ErrNameIncorrect
+		}
+		return append([]byte(nil),seg.buf.Bytes()...),nil
+	}
+	if part>=len(seg.parts){
+		return nil,ErrNameIncorrect
+	}
+	//the buffer is reused by the segment slide in after h.mu released
+	p := seg.parts[part]
+	return append([]byte(nil),seg.buf.Bytes()[p.start:p.end]...),nil
+}
+
+//targetDuration is the configured duration rounded up to seconds
+func targetDuration(d time.Duration) time.Duration {
+	return time.Duration(math.Ceil(d.Seconds()))*time.Second
+}
+
+//Init return the fmp4 init section named init_{id}.mp4
+func (h *hls) Init(name string) ([]byte,error) {
+	id,err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name,"init_"),".mp4"))
+	if err!= nil{
+		return nil,ErrNameIncorrect
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	bs,ok := h.inits[id]
+	if !ok{
+		return nil,ErrNameIncorrect
+	}
+	return bs,nil
 }
 
 func (h *hls) M3u8(preroute string) []byte {
 	var (
-		times = tstime.Seconds()
-		index int
+		first int
+		version = 6
+		initid = -1
+		ext = h.conf.Segment.ext()
 	)
+	if h.conf.Segment==Fmp4Segment{
+		version = 7
+	}
 	buf:=bufPool.Get().(*bytes.Buffer)
 	buf.Reset()
-	buf.WriteString(fmt.Sprintf(
-		"#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-ALLOW-CACHE:NO\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:%d\n\n",
-		times,h.m3uid))
+	defer bufPool.Put(buf)
 
 	h.mu.RLock()
-	if h.beginIndex<tslen{
-		index = h.beginIndex + Tslength - tslen
-	}else{
-		index = h.beginIndex -tslen
+	defer h.mu.RUnlock()
+	first = h.seq - h.conf.Length
+	if first<h.base{
+		first = h.base
 	}
-	h.mu.RUnlock()
+	buf.WriteString(fmt.Sprintf(
+		"#EXTM3U\n#EXT-X-VERSION:%d\n#EXT-X-TARGETDURATION:%d\n#EXT-X-PART-INF:PART-TARGET=%0.3f\n"+
+			"#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%0.3f\n"+
+			"#EXT-X-MEDIA-SEQUENCE:%d\n#EXT-X-DISCONTINUITY-SEQUENCE:%d\n\n",
+		version,int(h.target.Seconds()),parttime.Seconds(),parttime.Seconds()*3,first,h.discseq))
 
-	for i:=0;i<3;i++{
-		index = index % Tslength
-		buf.WriteString(fmt.Sprintf("#EXTINF:%0.3f,\n%s\n",times,  path.Join(preroute,h.tslist[index].name)))
-		index ++
+	for msn:=first;msn<=h.seq;msn++{
+		seg := h.tslist[msn%len(h.tslist)]
+		if seg.seq!=msn{
+			continue
+		}
+		if seg.discontinuity{
+			buf.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if h.conf.Segment==Fmp4Segment && seg.initid!=initid{
+			initid = seg.initid
+			buf.WriteString(fmt.Sprintf("#EXT-X-MAP:URI=\"%s\"\n",path.Join(preroute,fmt.Sprintf("init_%d.mp4",initid))))
+		}
+		//parts are only listed for the last segments near live edge
+		if msn>=h.seq-1{
+			for i,p:=range seg.parts{
+				buf.WriteString(fmt.Sprintf("#EXT-X-PART:DURATION=%0.3f,URI=\"%s\"",
+					p.duration.Seconds(),path.Join(preroute,fmt.Sprintf("%d_%d%s",msn,i,ext))))
+				if p.independent{
+					buf.WriteString(",INDEPENDENT=YES")
+				}
+				buf.WriteString("\n")
+			}
+		}
+		if seg.done{
+			buf.WriteString(fmt.Sprintf("#EXTINF:%0.3f,\n%s\n",seg.duration.Seconds(),path.Join(preroute,fmt.Sprintf("%d%s",msn,ext))))
+		}else{
+			buf.WriteString(fmt.Sprintf("#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%s\"\n",
+				path.Join(preroute,fmt.Sprintf("%d_%d%s",msn,len(seg.parts),ext))))
+		}
 	}
-	defer bufPool.Put(buf)
-	return buf.Bytes()
+	return append([]byte(nil),buf.Bytes()...)
 }
 
 
+//tsele is a media segment, parts are byte ranges of buf
 type tsele struct {
-	name string
+	seq int
+	initid int
+	//start is the decode time of first packet, at is the wall clock of it
+	start time.Duration
+	at time.Time
 	buf *bytes.Buffer
+	parts []*tspart
+	duration time.Duration
+	done bool
+	discontinuity bool
+	//independent is set when the writing part start with key frame
+	independent bool
+}
+
+type tspart struct {
+	start int
+	end int
+	duration time.Duration
+	independent bool
+}
+
+func (t *tsele) reset(seq int) {
+	t.seq = seq
+	t.buf.Reset()
+	t.parts = t.parts[:0]
+	t.duration = 0
+	t.done = false
+	t.discontinuity = false
+	t.independent = false
+}
+
+//segWriter append muxed data to the segment under lock
+type segWriter struct {
+	h *hls
+	seg *tsele
+}
+
+func (w *segWriter) Write(p []byte) (int,error) {
+	w.h.mu.Lock()
+	defer w.h.mu.Unlock()
+	return w.seg.buf.Write(p)
 }
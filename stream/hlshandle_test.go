@@ -0,0 +1,333 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/av/pubsub"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/nareix/joy4/format/mp4/mp4io"
+)
+
+var (
+	testsps,_ = hex.DecodeString("6764001eacd940a02ff9610000030001000003003c8f162d96")
+	testpps = []byte{0x68,0xeb,0xe3,0xcb,0x22,0xc0}
+)
+
+//newTestStream return a connected stream whose queue is fed by the test
+func newTestStream(t *testing.T) *Stream {
+	u,_ := url.Parse("rtsp://127.0.0.1/test")
+	s := &Stream{
+		fp:"test",
+		remote:u,
+		queue:pubsub.NewQueue(),
+		stopch:make(chan struct{}),
+		startch:make(chan struct{}),
+	}
+	s.queue.SetMaxGopCount(packetMaxSize)
+	cd,err := h264parser.NewCodecDataFromSPSAndPPS(testsps,testpps)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	s.queue.WriteHeader([]av.CodecData{cd})
+	close(s.startch)
+	return s
+}
+
+//feed write 25fps video packets with a key frame every gop frames
+func feed(s *Stream,from time.Duration,n int,gop int) time.Duration {
+	var (
+		frame = time.Second/25
+	)
+	for i:=0;i<n;i++{
+		s.queue.WritePacket(av.Packet{
+			Idx:0,
+			IsKeyFrame:i%gop==0,
+			Time:from,
+			Data:[]byte{0,0,0,2,0x65,0x88},
+		})
+		from+=frame
+	}
+	return from
+}
+
+func waitSeq(t *testing.T,h *hls,seq int) {
+	if !h.wait(nil,time.Second*5, func() bool {
+		return h.seq>=seq
+	}){
+		t.Fatalf("wait segment %d timeout",seq)
+	}
+}
+
+func TestHlsSegment(t *testing.T) {
+	s := newTestStream(t)
+	h := newHls(s)
+	h.Start()
+	defer h.Stop()
+	//let the segmenter wait on the empty queue
+	time.Sleep(time.Millisecond*100)
+
+	feed(s,0,25*25,25)
+	waitSeq(t,h,2)
+	if n:=s.Stats().Segments;n<2{
+		t.Errorf("segments produced %d, want at least 2",n)
+	}
+
+	m3u8 := string(h.M3u8("/live/test/"))
+	for _,want:=range []string{
+		"#EXT-X-PART-INF:PART-TARGET=0.500",
+		"#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES",
+		"#EXT-X-MEDIA-SEQUENCE:0",
+		"/live/test/0.ts",
+		"/live/test/1_0.ts\",INDEPENDENT=YES",
+		"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"/live/test/2_",
+	}{
+		if !strings.Contains(m3u8,want){
+			t.Errorf("playlist miss %s:\n%s",want,m3u8)
+		}
+	}
+	if strings.Contains(m3u8,"/live/test/0_0.ts"){
+		t.Errorf("parts of old segment should not be listed:\n%s",m3u8)
+	}
+
+	bs,err := h.Ts(nil,"0.ts")
+	if err!= nil || len(bs)==0 || len(bs)%188!=0{
+		t.Errorf("segment 0 invalid, len %d err %v",len(bs),err)
+	}
+	if _,err = h.Ts(nil,"2.ts");err==nil{
+		t.Errorf("segment in progress should not be served")
+	}
+	part,err := h.Ts(nil,"1_0.ts")
+	if err!= nil || len(part)==0{
+		t.Errorf("part 1_0 invalid, err %v",err)
+	}
+	//negative names are rejected, not index the ring
+	for _,name:=range []string{"-1.ts","-3_0.ts","1_-1.ts"}{
+		if _,err = h.Ts(nil,name);err!=ErrNameIncorrect{
+			t.Errorf("%s should be rejected, got %v",name,err)
+		}
+	}
+}
+
+func TestHlsBlockingReload(t *testing.T) {
+	s := newTestStream(t)
+	h := newHls(s)
+	h.Start()
+	defer h.Stop()
+
+	if code:=h.waitPlaylist(nil,5,-1);code!=400{
+		t.Errorf("msn too far should be 400, got %d",code)
+	}
+	done := make(chan int)
+	go func() {
+		done<-h.waitPlaylist(nil,0,3)
+	}()
+	select {
+	case code:=<-done:
+		t.Fatalf("should block, got %d",code)
+	case <-time.After(time.Millisecond*100):
+	}
+	feed(s,0,25*3,25)
+	select {
+	case code:=<-done:
+		if code!=200{
+			t.Errorf("want 200, got %d",code)
+		}
+	case <-time.After(time.Second*5):
+		t.Fatal("blocking reload not released")
+	}
+}
+
+func TestHlsFmp4(t *testing.T) {
+	s := newTestStream(t)
+	s.SetHlsConf(HlsConf{Segment:Fmp4Segment})
+	h := newHls(s)
+	h.Start()
+	defer h.Stop()
+	time.Sleep(time.Millisecond*100)
+
+	feed(s,0,25*12,25)
+	waitSeq(t,h,1)
+
+	m3u8 := string(h.M3u8("/live/test/"))
+	for _,want:=range []string{
+		"#EXT-X-VERSION:7",
+		"#EXT-X-MAP:URI=\"/live/test/init_1.mp4\"",
+		"/live/test/0.m4s",
+		"/live/test/1_0.m4s",
+	}{
+		if !strings.Contains(m3u8,want){
+			t.Errorf("playlist miss %s:\n%s",want,m3u8)
+		}
+	}
+	init,err := h.Init("init_1.mp4")
+	if err!= nil{
+		t.Fatal(err)
+	}
+	seg,err := h.Ts(nil,"0.m4s")
+	if err!= nil{
+		t.Fatal(err)
+	}
+	atoms,err := mp4io.ReadFileAtoms(bytes.NewReader(append(init,seg...)))
+	if err!= nil{
+		t.Fatal(err)
+	}
+	var (
+		moov,moof,mdat int
+		samples int
+	)
+	for _,atom:=range atoms{
+		switch atom.Tag() {
+		case mp4io.MOOV:
+			moov++
+		case mp4io.MOOF:
+			moof++
+			for _,traf:=range atom.(*mp4io.MovieFrag).Tracks{
+				samples+=len(traf.Run.Entries)
+			}
+		case mp4io.MDAT:
+			mdat++
+		}
+	}
+	//segment of 10s is cut into 0.5s parts, one fragment per part
+	if moov!=1 || moof!=21 || mdat!=21 || samples!=250{
+		t.Errorf("unexpected boxes moov %d moof %d mdat %d samples %d",moov,moof,mdat,samples)
+	}
+}
+
+func TestHlsKeyFrameAligned(t *testing.T) {
+	s := newTestStream(t)
+	h := newHls(s)
+	h.Start()
+	defer h.Stop()
+	time.Sleep(time.Millisecond*100)
+
+	//gop is 2.4s, segments is cut at the first key frame after 10s, and
+	//split without key frame before it exceed the target duration
+	feed(s,0,25*30,60)
+	waitSeq(t,h,2)
+
+	m3u8 := string(h.M3u8("/live/test/"))
+	for _,want:=range []string{
+		"#EXT-X-TARGETDURATION:10\n",
+		"#EXTINF:10.000,\n/live/test/0.ts",
+		"#EXTINF:10.000,\n/live/test/1.ts",
+	}{
+		if !strings.Contains(m3u8,want){
+			t.Errorf("playlist miss %s:\n%s",want,m3u8)
+		}
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if !h.tslist[0].parts[0].independent || h.tslist[1].parts[0].independent{
+		t.Errorf("only segment 0 start with key frame")
+	}
+}
+
+func TestHlsTargetDuration(t *testing.T) {
+	s := newTestStream(t)
+	s.SetHlsConf(HlsConf{Duration:time.Millisecond*1500,Length:5})
+	h := newHls(s)
+	h.Start()
+	defer h.Stop()
+	time.Sleep(time.Millisecond*100)
+
+	//the key frame every 1.2s, segments of 2.4s are not longer than 2s
+	feed(s,0,25*12,30)
+	waitSeq(t,h,4)
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.target!=time.Second*2{
+		t.Errorf("target duration should be 2s, got %s",h.target)
+	}
+	for _,seg:=range h.tslist{
+		if seg.done && seg.duration>h.target{
+			t.Errorf("segment %d is %s longer than target",seg.seq,seg.duration)
+		}
+	}
+}
+
+func TestHlsConf(t *testing.T) {
+	s := newTestStream(t)
+	s.SetHlsConf(HlsConf{Duration:time.Second*2,Length:5,Retain:8})
+	h := newHls(s)
+	if len(h.tslist)!=8{
+		t.Fatalf("ring size should be 8, got %d",len(h.tslist))
+	}
+	h.Start()
+	defer h.Stop()
+	time.Sleep(time.Millisecond*100)
+
+	feed(s,0,25*20,25)
+	waitSeq(t,h,9)
+
+	m3u8 := string(h.M3u8("/live/test/"))
+	if n:=strings.Count(m3u8,"#EXTINF:2.000,");n!=5{
+		t.Errorf("playlist should list 5 segments, got %d:\n%s",n,m3u8)
+	}
+	if !strings.Contains(m3u8,"#EXT-X-TARGETDURATION:2\n") || !strings.Contains(m3u8,"#EXT-X-MEDIA-SEQUENCE:4\n"){
+		t.Errorf("unexpected playlist:\n%s",m3u8)
+	}
+}
+
+func TestHlsUpdate(t *testing.T) {
+	s := newTestStream(t)
+	s.SetHlsConf(HlsConf{Duration:time.Second*2,Length:5,Retain:8})
+	hh := NewHlsHandler("/live/").(*HlsHandler)
+	if err:=hh.AddStreams(s);err!= nil{
+		t.Fatal(err)
+	}
+	defer hh.Stop()
+	h := hh.sts[s.Id()]
+	time.Sleep(time.Millisecond*100)
+	next := feed(s,0,25*12,25)
+	waitSeq(t,h,5)
+
+	s.SetHlsConf(HlsConf{Duration:time.Second*2,Length:3,Retain:4})
+	if err:=hh.UpdateStreams(s);err!= nil{
+		t.Fatal(err)
+	}
+	if hh.sts[s.Id()]!=h || len(h.tslist)!=4{
+		t.Fatalf("hls should be updated in place, ring size %d",len(h.tslist))
+	}
+	if _,err:=h.Ts(nil,"4.ts");err!= nil{
+		t.Errorf("segment kept should be served, %v",err)
+	}
+	h.mu.RLock()
+	seq := h.seq
+	h.mu.RUnlock()
+	m3u8 := string(h.M3u8("/live/test/"))
+	if n:=strings.Count(m3u8,"#EXTINF:");n!=3 || !strings.Contains(m3u8,fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d\n",seq-3)){
+		t.Errorf("playlist should list 3 segments before %d:\n%s",seq,m3u8)
+	}
+
+	//the segment format can not be changed in place, the media sequence continue
+	s.SetHlsConf(HlsConf{Segment:Fmp4Segment,Duration:time.Second*2,Length:3,Retain:4})
+	if err:=hh.UpdateStreams(s);err!= nil{
+		t.Fatal(err)
+	}
+	nh := hh.sts[s.Id()]
+	if nh==h || nh.base!=seq+1{
+		t.Fatalf("hls should be replaced from %d, got %d",seq+1,nh.base)
+	}
+	time.Sleep(time.Millisecond*100)
+	feed(s,next,25*6,25)
+	waitSeq(t,nh,seq+2)
+	m3u8 = string(nh.M3u8("/live/test/"))
+	for _,want:=range []string{
+		fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d\n",seq+1),
+		"#EXT-X-DISCONTINUITY\n",
+		fmt.Sprintf("/live/test/%d.m4s",seq+1),
+	}{
+		if !strings.Contains(m3u8,want){
+			t.Errorf("playlist miss %s:\n%s",want,m3u8)
+		}
+	}
+}
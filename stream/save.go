@@ -4,25 +4,76 @@ import (
 	"time"
 	"os"
 	"fmt"
-	"path/filepath"
 	"path"
 	"strings"
 	"strconv"
 	"sync"
+	"sync/atomic"
 
+	"github.com/nareix/joy4/av"
 	"github.com/nareix/joy4/format/mp4"
 )
 
+//RecordFormat is the mp4 layout of recordings
+type RecordFormat int
+
+const (
+	//Fmp4Record write fragments during recording, the file is playable after crash
+	Fmp4Record RecordFormat = iota
+	//Mp4Record write moov at the end of file
+	Mp4Record
+)
+
+//recordFragtime is the fragment duration of Fmp4Record
+const recordFragtime = time.Second
+
+//recordEvent is the tag in the file name of event recording
+const recordEvent = "event"
+
+func ParseRecordFormat(s string) (RecordFormat,error) {
+	switch s {
+	case "","fmp4":
+		return Fmp4Record,nil
+	case "mp4":
+		return Mp4Record,nil
+	}
+	return Fmp4Record,fmt.Errorf("record format %s not support, only fmp4,mp4",s)
+}
+
+func (f RecordFormat) String() string {
+	if f==Mp4Record{
+		return "mp4"
+	}
+	return "fmp4"
+}
+
 type Saveconf struct {
 	Dir string
+	//Format is fragmented mp4 by default
+	Format RecordFormat
+	//Maxtime is the max age of recordings, 0 is no limit
 	Maxtime time.Duration
 	Fragtime time.Duration
+	//MaxBytes is the max total size of recordings of one stream, 0 is no limit
+	MaxBytes int64
+	//MaxTotalBytes is the max total size of all recordings, 0 is no limit
+	MaxTotalBytes int64
+	//MinFree is the free space kept on the filesystem of Dir, 0 is no limit
+	MinFree int64
+	//PreRoll and PostRoll are the default time recorded before and after event
+	PreRoll time.Duration
+	PostRoll time.Duration
+	//Hook receive the recordings finalized and deleted, nil is disabled
+	Hook Hooker
 }
 
 func (c *Saveconf) valid() error{
 	var (
 		testfpath = path.Join(c.Dir,"test")
 	)
+	if c.Fragtime<=0{
+		return fmt.Errorf("save interval must be positive")
+	}
 	if info,err:=os.Stat(c.Dir);err!=nil{
 		return err
 	}else{
@@ -39,86 +90,595 @@ func (c *Saveconf) valid() error{
 	return nil
 }
 
+//SaveMp4 record every stream continuously, the file is rotated at the
+//first key frame after Fragtime
 type SaveMp4 struct {
-	c *Saveconf
-	s *Stream
-	mu sync.RWMutex
+	//c is *Saveconf, it is replaced by Reload
+	c atomic.Value
+	cat *Catalog
+	mu sync.Mutex
+	recs map[string]*recorder
+	events map[string]*recorder
+	stats map[string]*RecordStats
+	wg sync.WaitGroup
+	//reloadch wake loopDelete to apply the new retention
+	reloadch chan struct{}
 	stopch chan struct{}
 }
 
-func NewSaveMp4(c *Saveconf) (Saver,error){
+func NewSaveMp4(c *Saveconf,cat *Catalog) (Saver,error){
 	err := c.valid()
 	if err != nil{
 		return nil,err
 	}
-	return &SaveMp4{
-		c:c,
+	m := &SaveMp4{
+		cat:cat,
+		recs:make(map[string]*recorder),
+		events:make(map[string]*recorder),
+		stats:make(map[string]*RecordStats),
+		reloadch:make(chan struct{},1),
 		stopch: make(chan struct{}),
-	},nil
+	}
+	m.c.Store(c)
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		m.loopDelete()
+	}()
+	return m,nil
+}
+
+//retainInterval is half of Fragtime since the recordings grow by one file
+//every Fragtime, and not longer than a tenth of Maxtime, at least 1s
+func (c *Saveconf) retainInterval() time.Duration {
+	interval := c.Fragtime / 2
+	if c.Maxtime>0 && c.Maxtime/10<interval{
+		interval = c.Maxtime/10
+	}
+	if interval<time.Second{
+		interval = time.Second
+	}
+	return interval
 }
 
+//loopDelete enforce the retention every retainInterval, the interval is
+//read again when the config reloaded
 func (m *SaveMp4) loopDelete() {
+	timer := time.NewTimer(m.conf().retainInterval())
+	defer timer.Stop()
 	for {
 		select {
-		case <-time.NewTimer(m.c.Fragtime / 2).C:
-		}
-		aftertime := time.Now()
-		filepath.Walk(m.c.Dir, func(path string, info os.FileInfo, err error) error {
-			id,t:=splitname( info.Name())
-			if id==""{
-				fmt.Println("file",path,"not create file")
-				return nil
-			}
-			if !t.Add(m.c.Maxtime).After(aftertime){
-				os.RemoveAll(path)
-				fmt.Println("delete mp4 file",path)
-				return nil
+		case <-m.stopch:
+			return
+		case <-m.reloadch:
+			if !timer.Stop(){
+				<-timer.C
 			}
-			return nil
+		case <-timer.C:
+		}
+		m.retain(time.Now())
+		timer.Reset(m.conf().retainInterval())
+	}
+}
+
+//retain delete the recordings beyond the limits
+func (m *SaveMp4) retain(now time.Time) {
+	var (
+		free int64 = -1
+		c = m.conf()
+	)
+	if c.MinFree>0{
+		n,err := diskFree(c.Dir)
+		if err!= nil{
+			fmt.Println("module","savemp4","dir",c.Dir,"free space unknown",err)
+		}else{
+			free = n
+		}
+	}
+	for _,r:=range evictRecords(m.cat.Query("",time.Time{},time.Time{}),c,now,free){
+		err := os.Remove(r.Path)
+		if err!= nil && !os.IsNotExist(err){
+			fmt.Println("module","savemp4","delete file",r.Path,"failed",err)
+			continue
+		}
+		m.cat.Remove(r.Name)
+		m.count(r.Id, func(st *RecordStats) {
+			st.Deleted++
+			st.DeletedBytes+=r.Size
 		})
+		m.notify(HookDelete,r)
+		fmt.Println("delete mp4 file",r.Path)
 	}
 }
 
-func genname(s *Stream) string{
-	name := fmt.Sprintf("%s-%d.mp4",s.Id(),time.Now().Unix())
-	return name
+//evictRecords select the recordings to delete, records must be sorted by
+//start time, the oldest is evicted first and the file in writing is kept,
+//free is the free space of disk, negative is unknown
+func evictRecords(records []*Record,c *Saveconf,now time.Time,free int64) []*Record {
+	var (
+		evicted []*Record
+		done = make(map[string]bool)
+		total int64
+		perStream = make(map[string]int64)
+		need int64
+	)
+	evict := func(r *Record) {
+		done[r.Name] = true
+		total -= r.Size
+		perStream[r.Id] -= r.Size
+		need -= r.Size
+		evicted = append(evicted,r)
+	}
+	for _,r:=range records{
+		total += r.Size
+		perStream[r.Id] += r.Size
+	}
+	if c.MinFree>0 && free>=0{
+		need = c.MinFree-free
+	}
+	for _,r:=range records{
+		if r.Writing{
+			continue
+		}
+		switch {
+		case c.Maxtime>0 && !r.Start.Add(c.Maxtime).After(now):
+		case c.MaxBytes>0 && perStream[r.Id]>c.MaxBytes:
+		default:
+			continue
+		}
+		evict(r)
+	}
+	for _,r:=range records{
+		if r.Writing || done[r.Name]{
+			continue
+		}
+		if !(c.MaxTotalBytes>0 && total>c.MaxTotalBytes) && need<=0{
+			break
+		}
+		evict(r)
+	}
+	return evicted
 }
 
-func splitname(name string) (string,time.Time){
-	ids := strings.Split(name,"-")
-	if len(ids)!=2{
-		return "",time.Time{}
+//genname return {id}-{unix}.mp4 of continuous recording and {id}-{unix}.event.mp4
+//of event recording, n>0 is appended as {id}-{unix}.{n}.mp4 when the name is taken
+func genname(s *Stream,t time.Time,event bool,n int) string{
+	var (
+		tag string
+	)
+	if event{
+		tag += "."+recordEvent
 	}
-	ids[1]=ids[1][:len(ids[1])-4]
-	unixs,err := strconv.Atoi(ids[1])
+	if n>0{
+		tag += fmt.Sprintf(".%d",n)
+	}
+	return fmt.Sprintf("%s-%d%s.mp4",s.Id(),t.Unix(),tag)
+}
+
+//splitname return the stream id, the start in seconds and whether it is an
+//event recording
+func splitname(name string) (string,time.Time,bool){
+	//the named id may contain "-", so split from the end
+	i := strings.LastIndex(name,"-")
+	if i<=0 || !strings.HasSuffix(name,".mp4"){
+		return "",time.Time{},false
+	}
+	fields := strings.Split(name[i+1:len(name)-4],".")
+	unixs,err := strconv.Atoi(fields[0])
 	if err!= nil{
-		return "",time.Time{}
+		return "",time.Time{},false
 	}
-	return ids[0],time.Unix(int64(unixs),0)
+	event := false
+	for _,f:=range fields[1:]{
+		if f==recordEvent{
+			event = true
+			continue
+		}
+		if _,err = strconv.Atoi(f);err!= nil{
+			return "",time.Time{},false
+		}
+	}
+	return name[:i],time.Unix(int64(unixs),0),event
 }
 
+//Stop wait until the files in writing are finished, the streams
+//should be stopped before
 func (m *SaveMp4) Stop() {
 	close(m.stopch)
+	m.wg.Wait()
 }
 
+func (m *SaveMp4) conf() *Saveconf {
+	return m.c.Load().(*Saveconf)
+}
+
+//Reload replace the config in place, the recording in progress is kept,
+//the directory can not be changed
+func (m *SaveMp4) Reload(c *Saveconf) error {
+	if c.Dir!=m.conf().Dir{
+		return fmt.Errorf("save dir can not be changed from %s to %s",m.conf().Dir,c.Dir)
+	}
+	if err:=c.valid();err!= nil{
+		return err
+	}
+	m.c.Store(c)
+	select {
+	case m.reloadch<-struct{}{}:
+	default:
+	}
+	return nil
+}
+
+//Start record the stream until it or the saver stop, start twice is ignored
 func (m *SaveMp4) Start(s *Stream) {
 	m.mu.Lock()
-	m.s = s
-	go func(){
-		defer m.mu.Unlock()
-		name := genname(m.s)
-		f,err:=os.OpenFile(path.Join(m.c.Dir,name),os.O_CREATE|os.O_RDWR,os.ModePerm)
-		if err!= nil{
-			fmt.Println("module","savemp4","file",path.Join(m.c.Dir,name),"failed",err)
-			return
+	defer m.mu.Unlock()
+	//the recorder of restarted stream is replaced
+	if r,ok:=m.recs[s.Id()];ok && r.s==s{
+		return
+	}
+	r := &recorder{
+		m:m,
+		s:s,
+	}
+	m.recs[s.Id()]=r
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		err := r.run()
+		fmt.Println("module","savemp4","stream",s.Path(),"stopped",err)
+		m.mu.Lock()
+		if m.recs[s.Id()]==r{
+			delete(m.recs,s.Id())
 		}
-		mux:=mp4.NewMuxer(f)
-		err = s.WriteTo(mux,m.c.Fragtime)
-		if err!= nil{
-			fmt.Println("mp4 stream",m.s.Path(),"failed",err)
-			writeUntilSuccess(m.stopch,m.s,mux)
+		m.mu.Unlock()
+	}()
+}
+
+//RecordStats is the recordings of stream written and deleted since start
+type RecordStats struct {
+	Written int64
+	WrittenBytes int64
+	Deleted int64
+	DeletedBytes int64
+}
+
+//Stats return the recording counters by stream id, the deleted stream is included
+func (m *SaveMp4) Stats() map[string]RecordStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make(map[string]RecordStats,len(m.stats))
+	for id,st:=range m.stats{
+		res[id] = *st
+	}
+	return res
+}
+
+func (m *SaveMp4) count(id string,fn func(st *RecordStats)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st,ok := m.stats[id]
+	if !ok{
+		st = &RecordStats{}
+		m.stats[id] = st
+	}
+	fn(st)
+}
+
+//Event is the recording triggered by api
+type Event struct {
+	Stream string
+	Name string
+	//At is when it is triggered, Until is when the recording stop
+	At time.Time
+	Until time.Time
+	PreRoll time.Duration
+}
+
+//Event start a recording including pre of the cached packets, and stop
+//post after now. The event in recording of the stream is extended instead,
+//negative pre and zero post are the default of Saveconf, zero pre record
+//from the latest key frame
+func (m *SaveMp4) Event(s *Stream,name string,pre,post time.Duration) (*Event,error) {
+	var (
+		now = time.Now()
+	)
+	if post<0{
+		return nil,fmt.Errorf("post-roll must not be negative")
+	}
+	if pre<0{
+		pre = m.conf().PreRoll
+	}
+	if post==0{
+		post = m.conf().PostRoll
+	}
+	select {
+	case <-m.stopch:
+		return nil,fmt.Errorf("saver stopped")
+	default:
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if r,ok:=m.events[s.Id()];ok{
+		if now.Add(post).After(r.ev.Until){
+			r.ev.Until = now.Add(post)
+		}
+		ev := *r.ev
+		return &ev,nil
+	}
+	r := &recorder{
+		m:m,
+		s:s,
+		ev:&Event{
+			Stream:s.Id(),
+			Name:name,
+			At:now,
+			Until:now.Add(post),
+			PreRoll:pre,
+		},
+	}
+	m.events[s.Id()]=r
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		err := r.run()
+		fmt.Println("module","savemp4","stream",s.Path(),"event",name,"stopped",err)
+		m.mu.Lock()
+		delete(m.events,s.Id())
+		m.mu.Unlock()
+	}()
+	ev := *r.ev
+	return &ev,nil
+}
+
+//until return when the event recording stop
+func (r *recorder) until() time.Time {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	return r.ev.Until
+}
+
+//index put the recording into catalog
+func (m *SaveMp4) index(r *Record) {
+	cp := *r
+	if err:=m.cat.Put(&cp);err!= nil{
+		fmt.Println("module","savemp4","file",r.Path,"index failed",err)
+	}
+}
+
+func (m *SaveMp4) notify(typ string,r *Record) {
+	hook := m.conf().Hook
+	if hook==nil{
+		return
+	}
+	cp := *r
+	hook.Hook(&HookEvent{
+		Type:typ,
+		Stream:r.Id,
+		At:time.Now(),
+		Record:&cp,
+	})
+}
+
+//recorder read the stream by one cursor, so the files are continuous
+//and the cursor is kept when the source reconnect, the event recorder
+//write one file from the pre-roll until the event end
+type recorder struct {
+	m *SaveMp4
+	s *Stream
+	ev *Event
+	//preroll is the time before now of the first packet
+	preroll time.Duration
+	cds []av.CodecData
+	//idx is the stream used to decide where to rotate, video if there is
+	idx int8
+	video bool
+
+	f *os.File
+	mux av.Muxer
+	r *Record
+	//start is the time of first packet in file
+	start time.Duration
+}
+
+//recPacket is read by the reader of recorder, cds is set when the source
+//reconnected before the packet
+type recPacket struct {
+	pkt av.Packet
+	cds []av.CodecData
+	err error
+}
+
+//readPackets read the cursor in background, so the recorder is not blocked
+//when no packet come. ReadPacket can not be canceled, the reader exit at
+//the next packet after done closed
+func readPackets(cursor av.Demuxer,done <-chan struct{}) <-chan recPacket {
+	ch := make(chan recPacket)
+	go func() {
+		var (
+			last time.Duration
+			started bool
+		)
+		for {
+			pkt,err := cursor.ReadPacket()
+			rp := recPacket{pkt:pkt,err:err}
+			//source reconnected, timestamps start over
+			if err==nil && started && pkt.Time+time.Second<last{
+				rp.cds,rp.err = cursor.Streams()
+			}
+			last,started = pkt.Time,true
+			select {
+			case ch<-rp:
+			case <-done:
+				return
+			}
+			if rp.err!= nil{
+				return
+			}
 		}
 	}()
-	return
+	return ch
 }
 
+func (r *recorder) run() error {
+	var (
+		cursor av.Demuxer
+		err error
+		//expire is fired at the end of event, nil for continuous recording
+		expire <-chan time.Time
+		done = make(chan struct{})
+	)
+	r.s.Touch()
+	if r.ev!= nil{
+		cursor,r.preroll,err = r.s.PreRoll(r.m.stopch,r.ev.PreRoll)
+	}else{
+		cursor,err = r.s.Cursor(r.m.stopch)
+	}
+	if err!= nil{
+		return err
+	}
+	defer r.close()
+	cds,err := cursor.Streams()
+	if err!= nil{
+		return err
+	}
+	r.header(cds)
+	//the event is closed at Until even if no packet come
+	var timer *time.Timer
+	if r.ev!= nil{
+		timer = time.NewTimer(time.Until(r.until()))
+		defer timer.Stop()
+		expire = timer.C
+	}
+	defer close(done)
+	pkts := readPackets(cursor,done)
+	for {
+		var rp recPacket
+		select {
+		case <-r.m.stopch:
+			return nil
+		case <-expire:
+			//the event may be extended
+			if d:=time.Until(r.until());d>0{
+				timer.Reset(d)
+				continue
+			}
+			return nil
+		case rp = <-pkts:
+		}
+		if rp.err!= nil{
+			return rp.err
+		}
+		if rp.cds!= nil{
+			r.close()
+			r.header(rp.cds)
+		}
+		pkt := rp.pkt
+		key := pkt.Idx==r.idx && (pkt.IsKeyFrame || !r.video)
+		if key{
+			//keep the on demand source while recording
+			r.s.Touch()
+		}
+		if r.ev==nil && r.f!= nil && key && pkt.Time-r.start>=r.m.conf().Fragtime{
+			r.close()
+		}
+		if r.f==nil{
+			if !key{
+				continue
+			}
+			//retry at next key frame
+			if err = r.open(pkt.Time);err!= nil{
+				fmt.Println("module","savemp4","stream",r.s.Path(),"create file failed",err)
+				continue
+			}
+		}
+		pkt.Time -= r.start
+		if err = r.mux.WritePacket(pkt);err!= nil{
+			fmt.Println("module","savemp4","file",r.r.Path,"write failed",err)
+			r.close()
+		}
+	}
+}
+
+func (r *recorder) header(cds []av.CodecData) {
+	r.cds = cds
+	r.idx,r.video = 0,false
+	for i,cd:=range cds{
+		if cd.Type().IsVideo(){
+			r.idx,r.video = int8(i),true
+			break
+		}
+	}
+}
+
+//open create the next file, start is the time of its first packet
+func (r *recorder) open(start time.Duration) error {
+	var (
+		now = time.Now().Add(-r.preroll)
+		event = r.ev!= nil
+		name = genname(r.s,now,event,0)
+	)
+	r.preroll = 0
+	//the name is in seconds, files rotated in one second are numbered
+	for n:=1;;n++{
+		if _,err:=os.Stat(path.Join(r.m.conf().Dir,name));os.IsNotExist(err){
+			break
+		}
+		name = genname(r.s,now,event,n)
+	}
+	f,err := os.OpenFile(path.Join(r.m.conf().Dir,name),os.O_CREATE|os.O_RDWR|os.O_EXCL,0644)
+	if err!= nil{
+		return err
+	}
+	var mux av.Muxer = newFmp4FileMuxer(f,recordFragtime)
+	if r.m.conf().Format==Mp4Record{
+		mux = mp4.NewMuxer(f)
+	}
+	if err = mux.WriteHeader(r.cds);err!= nil{
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	r.f,r.mux,r.start = f,mux,start
+	r.r = &Record{
+		Id:r.s.Id(),
+		Name:name,
+		Path:f.Name(),
+		Start:now.Round(0),
+		Writing:true,
+	}
+	if r.ev!= nil{
+		r.r.Event = r.ev.Name
+	}
+	r.m.index(r.r)
+	return nil
+}
+
+//close finish the file and update the catalog
+func (r *recorder) close() {
+	var (
+		err error
+	)
+	if r.f==nil{
+		return
+	}
+	if err = r.mux.WriteTrailer();err!= nil{
+		fmt.Println("module","savemp4","file",r.r.Path,"write trailer failed",err)
+	}
+	r.f.Close()
+	r.r.Writing = false
+	if _,err = r.r.probe();err!= nil{
+		fmt.Println("module","savemp4","file",r.r.Path,"probe failed",err)
+	}
+	if info,err:=os.Stat(r.r.Path);err==nil{
+		r.r.Size = info.Size()
+	}
+	r.m.index(r.r)
+	size := r.r.Size
+	r.m.count(r.r.Id, func(st *RecordStats) {
+		st.Written++
+		st.WrittenBytes+=size
+	})
+	r.m.notify(HookRecord,r.r)
+	r.f,r.mux,r.r = nil,nil,nil
+}
@@ -0,0 +1,366 @@
+package stream
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSaveMp4Rotate(t *testing.T) {
+	for _,format:=range []RecordFormat{Fmp4Record,Mp4Record}{
+		t.Run(format.String(), func(t *testing.T) {
+			testSaveRotate(t,format)
+		})
+	}
+}
+
+func testSaveRotate(t *testing.T,format RecordFormat) {
+	dir,err := ioutil.TempDir("","save")
+	if err!= nil{
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c,err := OpenCatalog(dir)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	m,err := NewSaveMp4(&Saveconf{Dir:dir,Format:format,Maxtime:time.Hour,Fragtime:time.Second*2},c)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	s := newTestStream(t)
+	m.Start(s)
+	time.Sleep(time.Millisecond*100)
+
+	//10s with a key frame every second, then the source reconnect
+	feed(s,0,25*10,25)
+	time.Sleep(time.Millisecond*100)
+	feed(s,0,25*3,25)
+	time.Sleep(time.Millisecond*100)
+	s.Stop()
+	m.Stop()
+
+	records := c.Query(s.Id(),time.Time{},time.Time{})
+	//10s is cut into 5 files, the reconnect start a new file
+	if len(records)!=7{
+		t.Fatalf("want 7 files, got %d",len(records))
+	}
+	want := time.Second*2
+	if format==Mp4Record{
+		//mp4 muxer write the last sample with 0 duration
+		want -= time.Second/25
+	}
+	var total time.Duration
+	for i,r:=range records{
+		if r.Size==0 || r.Codec!="h264" || r.Writing{
+			t.Errorf("file %s not finished, size %d codec %s",r.Name,r.Size,r.Codec)
+		}
+		if (r.InitSize>0)!=(format==Fmp4Record){
+			t.Errorf("file %s init size %d unexpected",r.Name,r.InitSize)
+		}
+		if i<4 && r.Duration!=want{
+			t.Errorf("file %s should be %v, got %v",r.Name,want,r.Duration)
+		}
+		total += r.Duration
+	}
+	if total<time.Second*12 || total>time.Second*13{
+		t.Errorf("files should be continuous, total %v",total)
+	}
+	if st:=m.Stats()[s.Id()];st.Written!=7 || st.WrittenBytes==0 || st.Deleted!=0{
+		t.Errorf("record stats unexpected %+v",st)
+	}
+}
+
+func TestSaveFmp4Recover(t *testing.T) {
+	dir,err := ioutil.TempDir("","save")
+	if err!= nil{
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c,err := OpenCatalog(dir)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	m,err := NewSaveMp4(&Saveconf{Dir:dir,Maxtime:time.Hour,Fragtime:time.Hour},c)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	s := newTestStream(t)
+	m.Start(s)
+	time.Sleep(time.Millisecond*100)
+	feed(s,0,25*5,25)
+	time.Sleep(time.Millisecond*100)
+
+	//the server is killed, the last fragment is partly written
+	records := c.Query(s.Id(),time.Time{},time.Time{})
+	if len(records)!=1 || !records[0].Writing{
+		t.Fatalf("want 1 file in writing, got %+v",records)
+	}
+	path := records[0].Path
+	info,err := os.Stat(path)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	//4 fragments of 1s are flushed, the 5th is buffered and partly written
+	f,err := os.OpenFile(path,os.O_WRONLY|os.O_APPEND,0644)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	f.Write([]byte{0,0,0x10,0,'m','o','o','f',0,0,0,0})
+	f.Close()
+
+	c,err = OpenCatalog(dir)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	records = c.Query(s.Id(),time.Time{},time.Time{})
+	if len(records)!=1{
+		t.Fatalf("want 1 file, got %d",len(records))
+	}
+	r := records[0]
+	if r.Writing || r.Duration!=time.Second*4 || r.InitSize==0 || r.Size!=info.Size(){
+		t.Errorf("recovered file unexpected %+v, size on disk %d",r,info.Size())
+	}
+	if info,_ = os.Stat(path);info.Size()!=r.Size{
+		t.Errorf("partial fragment should be truncated, size %d",info.Size())
+	}
+	s.Stop()
+	m.Stop()
+}
+
+func TestEvictRecords(t *testing.T) {
+	var (
+		now = time.Unix(10000,0)
+		records []*Record
+	)
+	//a and b record 10 files of 100 bytes, the last file of a is in writing
+	for i:=0;i<10;i++{
+		for _,id:=range []string{"a","b"}{
+			r := &Record{
+				Id:id,
+				Name:fmt.Sprintf("%s-%d.mp4",id,1000*i),
+				Start:time.Unix(int64(1000*i),0),
+				Duration:time.Second*1000,
+				Size:100,
+			}
+			if id=="a" && i==9{
+				r.Writing = true
+			}
+			records = append(records,r)
+		}
+	}
+	names := func(rs []*Record) string {
+		var s []string
+		for _,r:=range rs{
+			s = append(s,r.Name)
+		}
+		return strings.Join(s,",")
+	}
+	for _,tc:=range []struct{
+		name string
+		c Saveconf
+		free int64
+		want string
+	}{
+		{"no limit",Saveconf{},-1,""},
+		{"age",Saveconf{Maxtime:time.Second*8000},-1,"a-0.mp4,b-0.mp4,a-1000.mp4,b-1000.mp4,a-2000.mp4,b-2000.mp4"},
+		{"stream bytes",Saveconf{MaxBytes:850},-1,"a-0.mp4,b-0.mp4,a-1000.mp4,b-1000.mp4"},
+		{"total bytes",Saveconf{MaxTotalBytes:1700},-1,"a-0.mp4,b-0.mp4,a-1000.mp4"},
+		{"free space",Saveconf{MinFree:1000},850,"a-0.mp4,b-0.mp4"},
+		{"free space unknown",Saveconf{MinFree:1000},-1,""},
+		{"keep writing",Saveconf{MaxBytes:1},-1,names(records[:18])+","+names(records[19:])},
+	}{
+		got := names(evictRecords(records,&tc.c,now,tc.free))
+		if got!=tc.want{
+			t.Errorf("%s: want %s, got %s",tc.name,tc.want,got)
+		}
+	}
+}
+
+func TestSaveEvent(t *testing.T) {
+	dir,err := ioutil.TempDir("","save")
+	if err!= nil{
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c,err := OpenCatalog(dir)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	m,err := NewSaveMp4(&Saveconf{Dir:dir,Fragtime:time.Hour,PreRoll:time.Second*3,PostRoll:time.Millisecond*300},c)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	s := newTestStream(t)
+	next := feed(s,0,25*10,25)
+
+	ev,err := m.Event(s,"door",-1,0)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	if ev.PreRoll!=time.Second*3 || ev.Until.Sub(ev.At)!=time.Millisecond*300{
+		t.Errorf("default pre-roll and post-roll not used %+v",ev)
+	}
+	//trigger again extend the recording
+	time.Sleep(time.Millisecond*100)
+	again,err := m.Event(s,"door",-1,0)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	if !again.At.Equal(ev.At) || !again.Until.After(ev.Until){
+		t.Errorf("event should be extended, first %+v again %+v",ev,again)
+	}
+	//live packets, faster than real time
+	for i:=0;i<100;i++{
+		next = feed(s,next,1,25)
+		time.Sleep(time.Millisecond*10)
+	}
+	s.Stop()
+	m.Stop()
+
+	records := c.Query(s.Id(),time.Time{},time.Time{})
+	if len(records)!=1{
+		t.Fatalf("want 1 file, got %d",len(records))
+	}
+	r := records[0]
+	if r.Event!="door" || r.Writing || !strings.HasSuffix(r.Name,".event.mp4"){
+		t.Errorf("unexpected record %+v",r)
+	}
+	//3s of pre-roll from the key frame at 7s, and about 400ms of post-roll
+	if r.Duration<time.Second*4 || r.Duration>=time.Second*10{
+		t.Errorf("event recording should contain pre-roll, got %v",r.Duration)
+	}
+	if len(RecordsIn(records,time.Time{},time.Time{}))!=0{
+		t.Errorf("event recording should not be stitched into vod")
+	}
+}
+
+func TestSaveEventUntil(t *testing.T) {
+	dir,err := ioutil.TempDir("","save")
+	if err!= nil{
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c,err := OpenCatalog(dir)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	m,err := NewSaveMp4(&Saveconf{Dir:dir,Fragtime:time.Hour,PreRoll:time.Second*3,PostRoll:time.Millisecond*300},c)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	s := newTestStream(t)
+	defer s.Stop()
+	next := feed(s,0,25*10,25)
+
+	//zero pre-roll is not the default
+	ev,err := m.Event(s,"door",0,0)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	if ev.PreRoll!=0{
+		t.Errorf("pre-roll should be 0, got %s",ev.PreRoll)
+	}
+	time.Sleep(time.Millisecond*100)
+	feed(s,next,25,25)
+
+	//no packet come after, the file is closed at Until
+	time.Sleep(time.Millisecond*500)
+	records := c.Query(s.Id(),time.Time{},time.Time{})
+	if len(records)!=1 || records[0].Writing{
+		t.Fatalf("event recording should be closed, got %+v",records)
+	}
+	if records[0].Duration>time.Second*2{
+		t.Errorf("event recording should not contain pre-roll, got %v",records[0].Duration)
+	}
+}
+
+func TestStreamName(t *testing.T) {
+	s,err := NewStream("rtsp://10.0.0.1:554/main",nil)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	for _,name:=range []string{"","front/door","door.1","../x"}{
+		if s.SetName(name)==nil{
+			t.Errorf("name %q should be invalid",name)
+		}
+	}
+	if err = s.SetName("front-door_1");err!= nil{
+		t.Fatal(err)
+	}
+	if s.Id()!="front-door_1"{
+		t.Errorf("id %s, want the name",s.Id())
+	}
+	at := time.Unix(1600000000,0)
+	for _,tc:=range []struct{
+		event bool
+		n int
+		name string
+	}{
+		{false,0,"front-door_1-1600000000.mp4"},
+		{false,2,"front-door_1-1600000000.2.mp4"},
+		{true,0,"front-door_1-1600000000.event.mp4"},
+		{true,1,"front-door_1-1600000000.event.1.mp4"},
+	}{
+		name := genname(s,at,tc.event,tc.n)
+		id,start,event := splitname(name)
+		if name!=tc.name || id!=s.Id() || !start.Equal(at) || event!=tc.event{
+			t.Errorf("split %s got %s %v %v",name,id,start,event)
+		}
+	}
+	if id,_,_:=splitname("a-1600000000.x.mp4");id!=""{
+		t.Errorf("unknown tag should be invalid, got %s",id)
+	}
+}
+
+func TestSaveReload(t *testing.T) {
+	dir := t.TempDir()
+	c,err := OpenCatalog(dir)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	m,err := NewSaveMp4(&Saveconf{Dir:dir,Maxtime:time.Hour,Fragtime:time.Hour},c)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	if err = m.Reload(&Saveconf{Dir:t.TempDir(),Fragtime:time.Hour});err==nil{
+		t.Error("save dir should not be changed")
+	}
+	if err = m.Reload(&Saveconf{Dir:dir});err==nil{
+		t.Error("invalid config should be rejected")
+	}
+	if err = m.Reload(&Saveconf{Dir:dir,Maxtime:time.Minute,Fragtime:time.Minute,PreRoll:time.Second*3});err!= nil{
+		t.Fatal(err)
+	}
+	if conf:=m.(*SaveMp4).conf();conf.Maxtime!=time.Minute || conf.PreRoll!=time.Second*3{
+		t.Errorf("config not replaced %+v",conf)
+	}
+
+	//the retention is applied at once, not after the interval of old config
+	old := &Record{Id:"test",Name:"test-1.mp4",Path:filepath.Join(dir,"test-1.mp4"),Start:time.Now().Add(-time.Hour*2)}
+	if err = ioutil.WriteFile(old.Path,[]byte("mp4"),0644);err!= nil{
+		t.Fatal(err)
+	}
+	if err = c.Put(old);err!= nil{
+		t.Fatal(err)
+	}
+	if err = m.Reload(&Saveconf{Dir:dir,Maxtime:time.Hour,Fragtime:time.Hour});err!= nil{
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second*2)
+	for len(c.Query("test",time.Time{},time.Time{}))>0 && time.Now().Before(deadline){
+		time.Sleep(time.Millisecond*10)
+	}
+	if _,err = os.Stat(old.Path);!os.IsNotExist(err){
+		t.Errorf("recording beyond Maxtime should be deleted after reload, %v",err)
+	}
+	if d:=(&Saveconf{Maxtime:time.Minute,Fragtime:time.Hour}).retainInterval();d!=time.Second*6{
+		t.Errorf("retain interval should follow Maxtime, got %s",d)
+	}
+}
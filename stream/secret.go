@@ -0,0 +1,92 @@
+package stream
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+//Secrets is the credentials of sources, the key is the stream name, the
+//source url without credentials or its host
+type Secrets map[string]*url.Userinfo
+
+//LoadSecrets read the secrets file, each line is "{key} {user}:{password}",
+//empty lines and lines start with # are ignored. The credentials may refer
+//to environment variables such as $CAM_PASS, which are expanded when dialing
+func LoadSecrets(fpath string) (Secrets,error) {
+	var (
+		secrets = make(Secrets)
+		lineno int
+	)
+	f,err := os.Open(fpath)
+	if err!= nil{
+		return nil,err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan(){
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line=="" || strings.HasPrefix(line,"#"){
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields)!=2{
+			return nil,fmt.Errorf("secrets %s line %d: want key and credential",fpath,lineno)
+		}
+		user,pass,ok := splitCredential(fields[1])
+		if !ok{
+			return nil,fmt.Errorf("secrets %s line %d: credential must be user:password",fpath,lineno)
+		}
+		secrets[fields[0]] = url.UserPassword(user,pass)
+	}
+	if err = scanner.Err();err!= nil{
+		return nil,err
+	}
+	return secrets,nil
+}
+
+func splitCredential(s string) (string,string,bool) {
+	i := strings.IndexByte(s,':')
+	if i<=0{
+		return "","",false
+	}
+	return s[:i],s[i+1:],true
+}
+
+//Lookup return the credential by name, then the source url, then its host,
+//nil if not found
+func (s Secrets) Lookup(name string,source string) *url.Userinfo {
+	if user,ok:=s[name];ok && name!=""{
+		return user
+	}
+	u,err := url.Parse(source)
+	if err!= nil{
+		return nil
+	}
+	if user,ok:=s[redact(u).String()];ok{
+		return user
+	}
+	return s[u.Host]
+}
+
+//redact return the url without credentials
+func redact(u *url.URL) *url.URL {
+	cp := *u
+	cp.User = nil
+	return &cp
+}
+
+//expandUser expand the environment variables in credential
+func expandUser(user *url.Userinfo) *url.Userinfo {
+	if user==nil{
+		return nil
+	}
+	pass,ok := user.Password()
+	if !ok{
+		return url.User(os.ExpandEnv(user.Username()))
+	}
+	return url.UserPassword(os.ExpandEnv(user.Username()),os.ExpandEnv(pass))
+}
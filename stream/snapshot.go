@@ -0,0 +1,182 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/nareix/joy4/format/mp4"
+)
+
+var (
+	annexbStartCode = []byte{0,0,0,1}
+)
+
+//Snapshot is the latest key frame of stream
+type Snapshot struct {
+	cd h264parser.CodecData
+	pkt av.Packet
+	//At is when the snapshot is taken
+	At time.Time
+}
+
+//Snapshot wait until the stream connected, and return its latest key frame,
+//the key frame cached before the source reconnect is not used, only h264 is
+//supported
+func (s *Stream) Snapshot(cancel <-chan struct{}) (*Snapshot,error) {
+	type result struct {
+		snap *Snapshot
+		err error
+	}
+	s.Touch()
+	cursor,err := s.Cursor(cancel)
+	if err!= nil{
+		return nil,err
+	}
+	s.mu.Lock()
+	keyed := s.keyed
+	s.mu.Unlock()
+	//the cached gop is from the last connection, wait the next key frame
+	if !keyed{
+		cursor = s.queue.Latest()
+	}
+	//ReadPacket can not be canceled, it return when packet come or stream stop
+	done := make(chan result,1)
+	go func() {
+		snap,err := keyFrame(cursor)
+		done<-result{snap,err}
+	}()
+	select {
+	case <-cancel:
+		return nil,fmt.Errorf("canceled")
+	case r:=<-done:
+		return r.snap,r.err
+	}
+}
+
+func keyFrame(cursor av.Demuxer) (*Snapshot,error) {
+	var (
+		idx = -1
+		snap = &Snapshot{}
+	)
+	cds,err := cursor.Streams()
+	if err!= nil{
+		return nil,err
+	}
+	for i,cd:=range cds{
+		if codec,ok:=cd.(h264parser.CodecData);ok{
+			idx,snap.cd = i,codec
+			break
+		}
+	}
+	if idx<0{
+		return nil,fmt.Errorf("stream has no h264 video")
+	}
+	for {
+		pkt,err := cursor.ReadPacket()
+		if err!= nil{
+			return nil,err
+		}
+		if int(pkt.Idx)==idx && pkt.IsKeyFrame{
+			pkt.Idx,pkt.Time,pkt.CompositionTime = 0,0,0
+			snap.pkt,snap.At = pkt,time.Now()
+			return snap,nil
+		}
+	}
+}
+
+//AnnexB return sps, pps and the frame with start codes
+func (s *Snapshot) AnnexB() []byte {
+	var (
+		buf bytes.Buffer
+	)
+	for _,nalu:=range [][]byte{s.cd.SPS(),s.cd.PPS()}{
+		buf.Write(annexbStartCode)
+		buf.Write(nalu)
+	}
+	nalus,_ := h264parser.SplitNALUs(s.pkt.Data)
+	for _,nalu:=range nalus{
+		buf.Write(annexbStartCode)
+		buf.Write(nalu)
+	}
+	return buf.Bytes()
+}
+
+//Mp4 return a mp4 file of the only frame
+func (s *Snapshot) Mp4() ([]byte,error) {
+	var (
+		w = &seekBuffer{}
+		mux = mp4.NewMuxer(w)
+	)
+	if err:=mux.WriteHeader([]av.CodecData{s.cd});err!= nil{
+		return nil,err
+	}
+	if err:=mux.WritePacket(s.pkt);err!= nil{
+		return nil,err
+	}
+	if err:=mux.WriteTrailer();err!= nil{
+		return nil,err
+	}
+	return w.buf,nil
+}
+
+//Jpeg decode the frame by ffmpeg compatible decoder, the annex-b stream is
+//written to stdin and the jpeg is read from stdout
+func (s *Snapshot) Jpeg(ctx context.Context,decoder string) ([]byte,error) {
+	var (
+		stdout,stderr bytes.Buffer
+	)
+	cmd := exec.CommandContext(ctx,decoder,"-hide_banner","-loglevel","error",
+		"-f","h264","-i","pipe:0","-frames:v","1","-f","image2","-c:v","mjpeg","pipe:1")
+	cmd.Stdin = bytes.NewReader(s.AnnexB())
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err:=cmd.Run();err!= nil{
+		return nil,fmt.Errorf("decoder %s failed: %v %s",decoder,err,bytes.TrimSpace(stderr.Bytes()))
+	}
+	if stdout.Len()==0{
+		return nil,fmt.Errorf("decoder %s output nothing",decoder)
+	}
+	return stdout.Bytes(),nil
+}
+
+//seekBuffer is io.WriteSeeker in memory
+type seekBuffer struct {
+	buf []byte
+	off int64
+}
+
+func (b *seekBuffer) Write(p []byte) (int,error) {
+	if end:=b.off+int64(len(p));end>int64(len(b.buf)){
+		b.buf = append(b.buf,make([]byte,end-int64(len(b.buf)))...)
+	}
+	n := copy(b.buf[b.off:],p)
+	b.off += int64(n)
+	return n,nil
+}
+
+func (b *seekBuffer) Seek(offset int64,whence int) (int64,error) {
+	var (
+		off int64
+	)
+	switch whence {
+	case io.SeekStart:
+		off = offset
+	case io.SeekCurrent:
+		off = b.off+offset
+	case io.SeekEnd:
+		off = int64(len(b.buf))+offset
+	default:
+		return 0,fmt.Errorf("seek whence %d invalid",whence)
+	}
+	if off<0{
+		return 0,fmt.Errorf("seek to negative position %d",off)
+	}
+	b.off = off
+	return off,nil
+}
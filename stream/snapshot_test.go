@@ -0,0 +1,117 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/format/mp4"
+)
+
+func TestSnapshot(t *testing.T) {
+	s := newTestStream(t)
+	//the latest key frame is the one at 2s
+	feed(s,0,60,25)
+	s.keyed = true
+
+	snap,err := s.Snapshot(nil)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	annexb := snap.AnnexB()
+	want := append(append(append(append(append([]byte{0,0,0,1},testsps...),0,0,0,1),testpps...),0,0,0,1),0x65,0x88)
+	if !bytes.Equal(annexb,want){
+		t.Errorf("annex-b unexpected %x",annexb)
+	}
+
+	bs,err := snap.Mp4()
+	if err!= nil{
+		t.Fatal(err)
+	}
+	demux := mp4.NewDemuxer(bytes.NewReader(bs))
+	if cds,err:=demux.Streams();err!= nil || len(cds)!=1{
+		t.Fatalf("mp4 streams %v err %v",cds,err)
+	}
+	pkt,err := demux.ReadPacket()
+	if err!= nil || !pkt.IsKeyFrame || pkt.Time!=0{
+		t.Errorf("mp4 should contain the key frame, got %+v err %v",pkt,err)
+	}
+	if _,err = demux.ReadPacket();err==nil{
+		t.Errorf("mp4 should contain only one frame")
+	}
+
+	//the decoder get annex-b from stdin
+	dir,err := ioutil.TempDir("","snapshot")
+	if err!= nil{
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	decoder := filepath.Join(dir,"decoder")
+	if err = ioutil.WriteFile(decoder,[]byte("#!/bin/sh\ncat\n"),0755);err!= nil{
+		t.Fatal(err)
+	}
+	jpeg,err := snap.Jpeg(context.Background(),decoder)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	if !bytes.Equal(jpeg,annexb){
+		t.Errorf("decoder input unexpected %x",jpeg)
+	}
+	if _,err = snap.Jpeg(context.Background(),filepath.Join(dir,"none"));err==nil{
+		t.Errorf("missing decoder should fail")
+	}
+}
+
+func TestSnapshotCancel(t *testing.T) {
+	s := newTestStream(t)
+	cancel := make(chan struct{})
+	go func() {
+		time.Sleep(time.Millisecond*100)
+		close(cancel)
+	}()
+	if _,err:=s.Snapshot(cancel);err==nil{
+		t.Errorf("snapshot of stream without packet should be canceled")
+	}
+	s.Stop()
+}
+
+func TestSnapshotStale(t *testing.T) {
+	s := newTestStream(t)
+	defer s.Stop()
+	//the gop cached by the last connection
+	feed(s,0,60,25)
+	type result struct {
+		snap *Snapshot
+		err error
+	}
+	cancel := make(chan struct{})
+	defer close(cancel)
+	done := make(chan result,1)
+	go func() {
+		snap,err := s.Snapshot(cancel)
+		done<-result{snap,err}
+	}()
+	select {
+	case r:=<-done:
+		t.Fatalf("snapshot should wait the key frame of current connection, got %+v",r)
+	case <-time.After(time.Millisecond*100):
+	}
+	fresh := []byte{0,0,0,2,0x65,0x99}
+	s.queue.WritePacket(av.Packet{Idx:0,IsKeyFrame:true,Time:0,Data:fresh})
+	select {
+	case r:=<-done:
+		if r.err!= nil{
+			t.Fatal(r.err)
+		}
+		if !bytes.Equal(r.snap.pkt.Data,fresh){
+			t.Errorf("stale key frame %x",r.snap.pkt.Data)
+		}
+	case <-time.After(time.Second*2):
+		t.Fatal("snapshot not returned after key frame")
+	}
+}
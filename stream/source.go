@@ -0,0 +1,34 @@
+package stream
+
+import (
+	"fmt"
+	"time"
+)
+
+//SourceConf is the options of dialing source, zero timeout is no limit.
+//The rtsp client only setup rtp interleaved in the rtsp connection, so the
+//transport is always tcp
+type SourceConf struct {
+	DialTimeout time.Duration
+	//ReadTimeout close the source when no data is read that long
+	ReadTimeout time.Duration
+	//KeepAlive is the interval of rtsp keepalive request
+	KeepAlive time.Duration
+	//Failover is how long the source is down before switching to the next
+	//backup, the primary is probed at the same interval to fail back
+	Failover time.Duration
+	//OnDemand dial the source when it is requested by viewer, and close it
+	//when nothing is requested in Idle
+	OnDemand bool
+	Idle time.Duration
+}
+
+func (c SourceConf) valid() error {
+	if c.DialTimeout<0 || c.ReadTimeout<0 || c.KeepAlive<0 || c.Failover<0{
+		return fmt.Errorf("source timeouts must not be negative")
+	}
+	if c.OnDemand && c.Idle<=0{
+		return fmt.Errorf("idle timeout of on demand source must be positive")
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package stream
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/h264parser"
+)
+
+//hangSource send one packet then block until closed, like a half-dead camera
+type hangSource struct {
+	fakeSource
+	closed chan struct{}
+}
+
+func (h *hangSource) ReadPacket() (av.Packet,error) {
+	if len(h.pkts)>0{
+		return h.fakeSource.ReadPacket()
+	}
+	<-h.closed
+	return av.Packet{},io.ErrClosedPipe
+}
+
+func (h *hangSource) Close() error {
+	select {
+	case <-h.closed:
+	default:
+		close(h.closed)
+	}
+	return nil
+}
+
+func TestSourceReadTimeout(t *testing.T) {
+	s := newTestStream(t)
+	cd,err := h264parser.NewCodecDataFromSPSAndPPS(testsps,testpps)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	if err = s.SetSourceConf(SourceConf{ReadTimeout:time.Millisecond*200});err!= nil{
+		t.Fatal(err)
+	}
+	s.demux = &hangSource{
+		fakeSource:fakeSource{
+			cds:[]av.CodecData{cd},
+			pkts:[]av.Packet{{IsKeyFrame:true,Data:[]byte{0,0,0,2,0x65,0x88}}},
+		},
+		closed:make(chan struct{}),
+	}
+	begin := time.Now()
+	err = s.copy()
+	if err==nil || !strings.Contains(err.Error(),"nothing read"){
+		t.Errorf("hang source should time out, got %v",err)
+	}
+	if elapsed:=time.Since(begin);elapsed>time.Second{
+		t.Errorf("timeout took %v",elapsed)
+	}
+	if st:=s.Stats();st.Bytes!=6{
+		t.Errorf("packet before hang should be copied, bytes %d",st.Bytes)
+	}
+}
+
+func TestSourceConf(t *testing.T) {
+	s := newTestStream(t)
+	if err:=s.SetSourceConf(SourceConf{DialTimeout:-1});err==nil{
+		t.Errorf("negative timeout should be rejected")
+	}
+}
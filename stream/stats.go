@@ -0,0 +1,236 @@
+package stream
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/h264parser"
+)
+
+const (
+	//statsWindow is the period of bitrate and fps measured
+	statsWindow = time.Second * 5
+)
+
+//Stats is the health of stream source
+type Stats struct {
+	//Source is the url connected, it is a backup after fail over
+	Source string
+	Connected bool
+	//Uptime is the time since current connection established
+	Uptime time.Duration
+	Reconnects int
+	//Attempts is the times of dialing source, failed included
+	Attempts int
+	LastError string
+	LastErrorAt time.Time
+	LastPacketAt time.Time
+	Bytes int64
+	//Bitrate is bits per second in last window
+	Bitrate int64
+	//Segments is the hls segments produced, Requests is the hls requests served
+	Segments int64
+	Requests int64
+	Video *VideoStats
+	Audio *AudioStats
+}
+
+type VideoStats struct {
+	Codec string
+	Width int
+	Height int
+	Fps float64
+	//Gop is the frames between last two key frames
+	Gop int
+	GopDuration time.Duration
+}
+
+type AudioStats struct {
+	Codec string
+	SampleRate int
+	Channels int
+}
+
+//stats is updated by the goroutine copying packets into queue
+type stats struct {
+	mu sync.Mutex
+	attempts int
+	connects int
+	connected bool
+	connectedAt time.Time
+	lastErr string
+	lastErrAt time.Time
+	lastPacketAt time.Time
+	bytes int64
+
+	cds []av.CodecData
+	videoidx int8
+
+	winStart time.Time
+	winBytes int64
+	//winFrom and winTo are the time of first and last video frame in window
+	winFrames int
+	winFrom,winTo time.Duration
+	bitrate int64
+	fps float64
+
+	gopFrames int
+	gop int
+	lastKey time.Duration
+	gopDur time.Duration
+
+	segments int64
+	requests int64
+}
+
+func (st *stats) attempt() {
+	st.mu.Lock()
+	st.attempts++
+	st.mu.Unlock()
+}
+
+func (st *stats) segment() {
+	st.mu.Lock()
+	st.segments++
+	st.mu.Unlock()
+}
+
+func (st *stats) request() {
+	st.mu.Lock()
+	st.requests++
+	st.mu.Unlock()
+}
+
+func (st *stats) connect(cds []av.CodecData) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.connects++
+	st.connected = true
+	st.connectedAt = time.Now()
+	st.winStart = st.connectedAt
+	st.winBytes,st.winFrames = 0,0
+	st.bitrate,st.fps = 0,0
+	st.gopFrames,st.gop,st.gopDur = 0,0,0
+	st.cds = cds
+	st.videoidx = -1
+	for i,cd:=range cds{
+		if cd.Type().IsVideo(){
+			st.videoidx = int8(i)
+			break
+		}
+	}
+}
+
+//fail record the error, and return whether the source was connected
+func (st *stats) fail(err error) bool {
+	if err==nil{
+		return false
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	connected := st.connected
+	st.connected = false
+	st.lastErr = err.Error()
+	st.lastErrAt = time.Now()
+	return connected
+}
+
+//idle record the on demand source is closed without error
+func (st *stats) idle() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.connected = false
+}
+
+func (st *stats) packet(pkt av.Packet) {
+	var (
+		now = time.Now()
+	)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.lastPacketAt = now
+	st.bytes += int64(len(pkt.Data))
+	st.winBytes += int64(len(pkt.Data))
+	if pkt.Idx==st.videoidx{
+		if st.winFrames==0{
+			st.winFrom = pkt.Time
+		}
+		st.winFrames++
+		st.winTo = pkt.Time
+		if pkt.IsKeyFrame{
+			if st.gopFrames>0{
+				st.gop = st.gopFrames
+				st.gopDur = pkt.Time-st.lastKey
+			}
+			st.gopFrames = 0
+			st.lastKey = pkt.Time
+		}
+		st.gopFrames++
+	}
+	if elapsed:=now.Sub(st.winStart);elapsed>=statsWindow{
+		st.bitrate = st.winBytes*8*int64(time.Second)/int64(elapsed)
+		if st.winFrames>1 && st.winTo>st.winFrom{
+			st.fps = float64(st.winFrames-1)/(st.winTo-st.winFrom).Seconds()
+		}
+		st.winStart = now
+		st.winBytes,st.winFrames = 0,0
+	}
+}
+
+func (st *stats) get() Stats {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s := Stats{
+		Connected:st.connected,
+		LastError:st.lastErr,
+		LastErrorAt:st.lastErrAt,
+		LastPacketAt:st.lastPacketAt,
+		Bytes:st.bytes,
+		Bitrate:st.bitrate,
+		Attempts:st.attempts,
+		Segments:st.segments,
+		Requests:st.requests,
+	}
+	if st.connects>1{
+		s.Reconnects = st.connects-1
+	}
+	if st.connected{
+		s.Uptime = time.Since(st.connectedAt)
+	}
+	for _,cd:=range st.cds{
+		switch codec:=cd.(type) {
+		case h264parser.CodecData:
+			if s.Video!= nil{
+				continue
+			}
+			s.Video = &VideoStats{
+				Codec:cd.Type().String(),
+				Width:codec.Width(),
+				Height:codec.Height(),
+				Fps:st.fps,
+				Gop:st.gop,
+				GopDuration:st.gopDur,
+			}
+		case av.AudioCodecData:
+			if s.Audio!= nil{
+				continue
+			}
+			s.Audio = &AudioStats{
+				Codec:cd.Type().String(),
+				SampleRate:codec.SampleRate(),
+				Channels:codec.ChannelLayout().Count(),
+			}
+		default:
+			if cd.Type().IsVideo() && s.Video==nil{
+				s.Video = &VideoStats{
+					Codec:cd.Type().String(),
+					Fps:st.fps,
+					Gop:st.gop,
+					GopDuration:st.gopDur,
+				}
+			}
+		}
+	}
+	return s
+}
@@ -0,0 +1,92 @@
+package stream
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/h264parser"
+)
+
+//fakeSource return packets then io.EOF
+type fakeSource struct {
+	cds []av.CodecData
+	pkts []av.Packet
+}
+
+func (f *fakeSource) Streams() ([]av.CodecData,error) {
+	return f.cds,nil
+}
+
+func (f *fakeSource) ReadPacket() (av.Packet,error) {
+	if len(f.pkts)==0{
+		return av.Packet{},io.EOF
+	}
+	pkt := f.pkts[0]
+	f.pkts = f.pkts[1:]
+	return pkt,nil
+}
+
+func (f *fakeSource) Close() error {
+	return nil
+}
+
+func TestStats(t *testing.T) {
+	var (
+		frame = time.Second/25
+		src = &fakeSource{}
+	)
+	s := newTestStream(t)
+	cd,err := h264parser.NewCodecDataFromSPSAndPPS(testsps,testpps)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	src.cds = []av.CodecData{cd}
+	for i:=0;i<60;i++{
+		src.pkts = append(src.pkts,av.Packet{
+			IsKeyFrame:i%25==0,
+			Time:frame*time.Duration(i),
+			Data:make([]byte,100),
+		})
+	}
+	s.demux = src
+	if err = s.copy();err==nil{
+		t.Fatalf("copy should fail when source closed")
+	}
+	st := s.Stats()
+	if !st.Connected || st.Reconnects!=0 || st.Bytes!=6000 || st.LastPacketAt.IsZero(){
+		t.Errorf("stats unexpected %+v",st)
+	}
+	if st.Video==nil || st.Video.Codec!="H264" || st.Video.Width!=cd.Width() || st.Video.Height!=cd.Height(){
+		t.Fatalf("video unexpected %+v",st.Video)
+	}
+	if st.Video.Gop!=25 || st.Video.GopDuration!=time.Second{
+		t.Errorf("gop %d %v, want 25 1s",st.Video.Gop,st.Video.GopDuration)
+	}
+	if st.Audio!= nil{
+		t.Errorf("audio should be empty")
+	}
+
+	//close the window, 60 frames in 5s
+	s.stats.winStart = time.Now().Add(-statsWindow)
+	s.stats.packet(av.Packet{Time:frame*60,Data:make([]byte,100)})
+	st = s.Stats()
+	if st.Bitrate<9000 || st.Bitrate>9800{
+		t.Errorf("bitrate %d, want about 6100*8/5",st.Bitrate)
+	}
+	if st.Video.Fps!=25{
+		t.Errorf("fps %v, want 25",st.Video.Fps)
+	}
+
+	s.stats.fail(fmt.Errorf("source closed"))
+	st = s.Stats()
+	if st.Connected || st.Uptime!=0 || st.LastError!="source closed" || st.LastErrorAt.IsZero(){
+		t.Errorf("stats after fail unexpected %+v",st)
+	}
+	s.stats.connect(src.cds)
+	if st = s.Stats();st.Reconnects!=1 || !st.Connected || st.Video.Gop!=0{
+		t.Errorf("stats after reconnect unexpected %+v",st)
+	}
+}
@@ -2,13 +2,16 @@ package stream
 
 import (
 	"fmt"
+	"io"
 	"net/url"
 	"hash/crc32"
+	"regexp"
+	"sync"
+	"sync/atomic"
 
 	"time"
 
 	"github.com/nareix/joy4/av"
-	"github.com/nareix/joy4/av/avutil"
 	"github.com/nareix/joy4/av/pubsub"
 	"github.com/nareix/joy4/format/rtsp"
 	"github.com/nareix/joy4/format/rtmp"
@@ -19,78 +22,143 @@ import (
 var (
 
 	packetMaxSize = 64
+	validName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
 )
 
 type Stream struct {
 	fp string
+	//remote has no credentials, user is injected only when dialing
 	remote *url.URL
+	user *url.Userinfo
+	//backups are switched to in order when the active source is down
+	backups []*source
 
 	queue *pubsub.Queue
 
-	demux av.Demuxer
+	mu sync.Mutex
+	demux av.DemuxCloser
+	//active is the index of source connected, 0 is the primary
+	active int
+	//pending is the primary connected while a backup is active
+	pending av.DemuxCloser
 
 	stopch chan struct{}
+	//startch is closed when connected and renewed when the connection lost,
+	//it is guarded by mu and read by started
 	startch chan struct{}
+	//keyed is whether a key frame of the current connection is in queue, the
+	//gop cached before is stale until then. It is guarded by mu
+	keyed bool
 	pool *ants.Pool
+
+	hlsconf HlsConf
+	srcconf SourceConf
+	//dialer replace dial in tests
+	dialer func(src *source) (av.DemuxCloser,error)
+	stats stats
+	hook Hooker
+
+	//pulling is closed to stop pulling the on demand source, nil when idle
+	pulling chan struct{}
+	//pulled is closed when the last pulling exit
+	pulled chan struct{}
+	//lastUse is when the on demand stream was used by viewer
+	lastUse time.Time
 }
 
 func NewStream(s string,pool *ants.Pool) (*Stream,error) {
-	u,err:=url.Parse(s)
+	src,err := parseSource(s)
 	if err!= nil{
 		return nil,err
 	}
+	//the id of url with credentials is the same as without
+	fp := fingerPrint([]byte(s))
+	if src.user!= nil{
+		fp = fingerPrint([]byte(src.remote.String()))
+	}
 	queue:=pubsub.NewQueue()
 	queue.SetMaxGopCount(packetMaxSize)
 	news := &Stream{
-		fp:fingerPrint([]byte(s)),
-		remote:u,
+		fp:fp,
+		remote:src.remote,
+		user:src.user,
 		stopch: make(chan struct{}),
 		startch:make(chan struct{}),
 		queue:queue,
 		pool:pool ,
 	}
-	err = news.valid()
-	if err!= nil{
-		return nil,err
-	}
 	return news,nil
 }
 
-
-func (s *Stream) valid() error{
-	var (
-		url2 = s.remote
-	)
-	switch url2.Scheme{
-	case "rtsp":
-	case "rtmp":
-	default:
-		return fmt.Errorf("scheme %s not support",url2.Scheme)
-	}
-	if url2.Host==""{
-		return fmt.Errorf("host is none")
-	}
-	return nil
-}
-
+//Start pull the source, the on demand stream is pulled by Touch
 func (s *Stream) Start( ) {
-	go s.run(time.Minute * 5)
+	if s.srcconf.OnDemand{
+		return
+	}
+	go s.run(s.stopch,time.Minute * 5)
 }
 
+//Stop close the source and queue, Stop twice is safe
 func (s *Stream) Stop( ) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.stopch:
+		return
+	default:
+	}
 	close(s.stopch)
+	if s.demux!= nil{
+		s.demux.Close()
+	}
+	if s.pending!= nil{
+		s.pending.Close()
+		s.pending = nil
+	}
+	s.queue.Close()
 }
 
-func (s *Stream) run(maxwait time.Duration) {
+//run pull the source until stop closed
+func (s *Stream) run(stop <-chan struct{},maxwait time.Duration) {
 	var (
 		err error
-		retry = time.Second * 5
+		mind = time.Second * 5
+		retry = mind
+		cur int
+		//down is when the current source failed
+		down time.Time
 	)
 	for {
-		err = s.conn()
+		//the primary recovered while a backup was active
+		if cur!=0 && s.hasPending(){
+			cur = 0
+		}
+		s.stats.attempt()
+		err = s.conn(cur,stop)
 		if err != nil {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			s.stats.fail(err)
+			if down.IsZero(){
+				down = time.Now()
+			}
+			if len(s.backups)>0 && time.Since(down)>=s.srcconf.Failover{
+				cur = (cur+1)%(len(s.backups)+1)
+				down = time.Now()
+				fmt.Println("stream",s.Path(),"fail over to",s.sourceAt(cur).remote.String())
+				//try the next source at once, unless all sources failed
+				if cur!=0{
+					retry = mind
+					continue
+				}
+			}
 			fmt.Println("stream",s.Path(),"conn faile",err,"conn next time",time.Now().Add(retry).String())
 			select {
+			case <-stop:
+				return
 			case <-time.NewTimer(retry).C:
 				retry = retry * 2
 			}
@@ -99,59 +167,351 @@ func (s *Stream) run(maxwait time.Duration) {
 			}
 			continue
 		}
+		retry = mind
+		down = time.Time{}
+		s.mu.Lock()
 		close(s.startch)
-		err = avutil.CopyFile(s.queue,s.demux)
-		if err != nil {
-			fmt.Println("stream",s.Path(),"conn faile",err)
-			continue
+		s.mu.Unlock()
+		probe := make(chan struct{})
+		if cur!=0{
+			go s.probePrimary(probe,s.demux)
 		}
+		err = s.copy()
+		close(probe)
+		s.mu.Lock()
 		s.startch=make(chan struct{})
+		s.keyed = false
+		s.mu.Unlock()
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if cur!=0 && s.hasPending(){
+			fmt.Println("stream",s.Path(),"fail back to primary")
+			continue
+		}
+		down = time.Now()
+		if s.stats.fail(err){
+			s.notify(HookDisconnect,err)
+		}
+		fmt.Println("stream",s.Path(),"conn faile",err)
+	}
+}
+
+//copy write packets from source into queue until source failed, the
+//source is closed when nothing is read in ReadTimeout
+func (s *Stream) copy() error {
+	var (
+		demux = s.demux
+		timeout = s.srcconf.ReadTimeout
+		timedout int32
+		reset = func() {}
+	)
+	if timeout>0{
+		watchdog := time.AfterFunc(timeout, func() {
+			atomic.StoreInt32(&timedout,1)
+			demux.Close()
+		})
+		defer watchdog.Stop()
+		reset = func() {
+			watchdog.Reset(timeout)
+		}
+	}
+	err := s.copyPackets(demux,reset)
+	if atomic.LoadInt32(&timedout)==1{
+		return fmt.Errorf("nothing read in %v",timeout)
+	}
+	return err
+}
+
+func (s *Stream) copyPackets(demux av.Demuxer,reset func()) error {
+	cds,err := demux.Streams()
+	if err!= nil{
+		return err
+	}
+	reset()
+	s.stats.connect(cds)
+	s.notify(HookConnect,nil)
+	if err = s.queue.WriteHeader(cds);err!= nil{
+		return err
+	}
+	//timestamps of every connection start from 0, so the readers see them
+	//going backwards when source reconnect or switch
+	var (
+		base time.Duration
+		first = true
+		keyed bool
+		videoidx int8 = -1
+	)
+	for i,cd:=range cds{
+		if cd.Type().IsVideo(){
+			videoidx = int8(i)
+			break
+		}
+	}
+	for {
+		pkt,err := demux.ReadPacket()
+		if err!= nil{
+			if err==io.EOF{
+				return fmt.Errorf("source closed")
+			}
+			return err
+		}
+		reset()
+		if first{
+			base,first = pkt.Time,false
+		}
+		if pkt.Time -= base;pkt.Time<0{
+			pkt.Time = 0
+		}
+		s.stats.packet(pkt)
+		if err = s.queue.WritePacket(pkt);err!= nil{
+			return err
+		}
+		if !keyed && pkt.Idx==videoidx && pkt.IsKeyFrame{
+			keyed = true
+			s.mu.Lock()
+			s.keyed = true
+			s.mu.Unlock()
+		}
 	}
 }
 
-func (s *Stream) WriteTo(mux av.Muxer,duration time.Duration) error{
+//Stats return the health of source
+func (s *Stream) Stats() Stats {
+	st := s.stats.get()
+	s.mu.Lock()
+	st.Source = s.sourceAt(s.active).remote.String()
+	s.mu.Unlock()
+	return st
+}
+
+//started return the channel closed when the stream connected
+func (s *Stream) started() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.startch
+}
+
+//Cursor wait until the stream connected, and return a reader which start
+//from the latest gop in queue
+func (s *Stream) Cursor(stopch <-chan struct{}) (*pubsub.QueueCursor,error){
 	select {
 	case <-s.stopch:
-		return fmt.Errorf("stream stop")
-	case <-s.startch:
+		return nil,fmt.Errorf("stream stop")
+	case <-stopch:
+		return nil,fmt.Errorf("canceled")
+	case <-s.started():
 	}
+	return s.queue.DelayedGopCount(1),nil
+}
 
-	cds,err := s.demux.Streams()
+//PreRoll wait until the stream connected, and return a reader which start
+//from the key frame at least pre before the latest packet, the oldest key
+//frame in queue is used if pre is longer than the cache. The pre-roll in
+//reader is returned too
+func (s *Stream) PreRoll(stopch <-chan struct{},pre time.Duration) (av.Demuxer,time.Duration,error){
+	var (
+		buf []av.Packet
+		idx int8 = -1
+	)
+	select {
+	case <-s.stopch:
+		return nil,0,fmt.Errorf("stream stop")
+	case <-stopch:
+		return nil,0,fmt.Errorf("canceled")
+	case <-s.started():
+	}
+	cds,err := s.queue.Oldest().Streams()
 	if err!= nil{
-		return err
+		return nil,0,err
+	}
+	for i,cd:=range cds{
+		if cd.Type().IsVideo(){
+			idx = int8(i)
+			break
+		}
+	}
+	//the next packet is the live edge
+	live,err := s.queue.Latest().ReadPacket()
+	if err!= nil{
+		return nil,0,err
+	}
+	target := live.Time-pre
+	cursor := s.queue.Oldest()
+	for {
+		pkt,err := cursor.ReadPacket()
+		if err!= nil{
+			return nil,0,err
+		}
+		//source reconnected, timestamps start over
+		if len(buf)>0 && pkt.Time+time.Second<buf[len(buf)-1].Time{
+			buf = buf[:0]
+		}
+		key := idx<0 || (pkt.Idx==idx && pkt.IsKeyFrame)
+		switch {
+		case key && (pkt.Time<=target || len(buf)==0):
+			buf = append(buf[:0],pkt)
+		case len(buf)>0:
+			buf = append(buf,pkt)
+		}
+		if len(buf)>0 && pkt.Time>=target{
+			return &preRollCursor{QueueCursor:cursor,buf:buf},live.Time-buf[0].Time,nil
+		}
+	}
+}
+
+//preRollCursor return the packets buffered before reading the queue
+type preRollCursor struct {
+	*pubsub.QueueCursor
+	buf []av.Packet
+}
+
+func (c *preRollCursor) ReadPacket() (av.Packet,error){
+	if len(c.buf)>0{
+		pkt := c.buf[0]
+		c.buf = c.buf[1:]
+		return pkt,nil
+	}
+	return c.QueueCursor.ReadPacket()
+}
+
+//conn connect the source of index, the pending primary is used if any
+func (s *Stream) conn(idx int,stop <-chan struct{}) error {
+	var (
+		src = s.sourceAt(idx)
+		cli av.DemuxCloser
+		err error
+	)
+	if idx==0{
+		s.mu.Lock()
+		cli,s.pending = s.pending,nil
+		s.mu.Unlock()
+	}
+	if cli==nil{
+		cli,err = s.dial(src)
+		if err!= nil{
+			fmt.Println("remote",src.remote.String(),"failed",err,)
+			return err
+		}
 	}
-	mux.WriteHeader(cds)
-	s.pool.Submit(func(){startwrite(s.startch,s.queue,duration,mux)})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.stopch:
+		cli.Close()
+		return fmt.Errorf("stream stop")
+	case <-stop:
+		cli.Close()
+		return fmt.Errorf("stream idle")
+	default:
+	}
+	if idx!=s.active{
+		s.notifySwitch(src)
+	}
+	s.demux = cli
+	s.active = idx
 	return nil
 }
 
-func (s *Stream) conn( ) error {
+func (s *Stream) dial(src *source) (av.DemuxCloser,error) {
 	var (
-		cli interface{}
+		cli av.DemuxCloser
 		err error
 	)
-	switch s.remote.Scheme {
+	if s.dialer!= nil{
+		return s.dialer(src)
+	}
+	switch src.remote.Scheme {
 	case "rtsp":
-		cli,err = rtsp.Dial(s.remote.String())
+		var rc *rtsp.Client
+		rc,err = rtsp.DialTimeout(src.dialUrl(),s.srcconf.DialTimeout)
+		if err==nil{
+			//the read deadline of rtsp connection
+			rc.RtspTimeout = s.srcconf.ReadTimeout
+			rc.RtpKeepAliveTimeout = s.srcconf.KeepAlive
+			cli = rc
+		}
 	case "rtmp":
-		cli, err = rtmp.Dial(s.remote.String())
+		cli, err = rtmp.DialTimeout(src.dialUrl(),s.srcconf.DialTimeout)
+	default:
+		err = fmt.Errorf("scheme %s not support",src.remote.Scheme)
 	}
 	if err!= nil{
-		fmt.Println("remote",s.remote.String(),"failed",err,)
-		return err
+		return nil,src.redactErr(err)
 	}
-	s.demux = cli.(av.Demuxer)
-	return nil
+	return cli,nil
 }
 
 func (s *Stream) Id() string{
 	return s.fp
 }
 
-func (s *Stream) Clone() *Stream{
-	news,_ := NewStream(s.remote.String(),s.pool)
-	news.Start()
-	return news
+//SetCredential replace the credential of source, the environment variables
+//such as $CAM_PASS are expanded when dialing. It must be called before the
+//stream start
+func (s *Stream) SetCredential(user *url.Userinfo) {
+	s.user = user
+}
+
+//SetName replace the fingerprint id with a stable name, the name is used
+//in urls and recording files, so only letters, digits, _ and - are allowed.
+//It must be called before the stream is added
+func (s *Stream) SetName(name string) error {
+	if !validName.MatchString(name){
+		return fmt.Errorf("stream name %q invalid, only letters, digits, _ and - are allowed",name)
+	}
+	s.fp = name
+	return nil
+}
+
+//SetHook must be called before the stream start
+func (s *Stream) SetHook(h Hooker) {
+	s.hook = h
+}
+
+func (s *Stream) notify(typ string,err error) {
+	if s.hook==nil{
+		return
+	}
+	ev := &HookEvent{
+		Type:typ,
+		Stream:s.Id(),
+		Url:s.Path(),
+		At:time.Now(),
+	}
+	if err!= nil{
+		ev.Error = err.Error()
+	}
+	s.hook.Hook(ev)
+}
+
+//SetSourceConf must be called before the stream start
+func (s *Stream) SetSourceConf(c SourceConf) error {
+	if err:=c.valid();err!= nil{
+		return err
+	}
+	s.srcconf = c
+	return nil
+}
+
+func (s *Stream) SourceConf() SourceConf {
+	return s.srcconf
+}
+
+//SetHlsConf is applied when the stream added to handler, or by UpdateStreams
+//of handler when it is running
+func (s *Stream) SetHlsConf(c HlsConf) {
+	s.mu.Lock()
+	s.hlsconf = c
+	s.mu.Unlock()
+}
+
+func (s *Stream) HlsConf() HlsConf {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hlsconf
 }
 
 func (s *Stream) Path() string{
@@ -164,34 +524,3 @@ func fingerPrint(bs []byte) string{
 	ha.Write([]byte(bs))
 	return fmt.Sprintf("%x",ha.Sum32())
 }
-
-func startwrite(stopch <-chan struct{},reader *pubsub.Queue,du time.Duration , mux av.Muxer){
-	var (
-		cursor = reader.Oldest()
-		err error
-	)
-	timer := time.NewTimer(du)
-	for {
-		select {
-		case <-stopch:
-			err = mux.WriteTrailer()
-			fmt.Println("muxer","stop","message","context cancled")
-			return
-		case <-timer.C:
-			err = mux.WriteTrailer()
-			fmt.Println("muxer","time over","message",err)
-			return
-		default:
-			packet , err := cursor.ReadPacket()
-			if err!= nil{
-				fmt.Println("queue","read","failed",err)
-				return
-			}
-			err = mux.WritePacket(packet)
-			if err!= nil{
-				fmt.Println("muxer","write","failed",err)
-				return
-			}
-		}
-	}
-}
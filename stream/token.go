@@ -0,0 +1,158 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrTokenInvalid = errors.New("token is invalid")
+	ErrTokenExpired = errors.New("token is expired")
+
+	//uriAttr match the URI attribute of playlist tags
+	uriAttr = regexp.MustCompile(`URI="([^"]*)"`)
+	//templateAttr match the segment template of mpd
+	templateAttr = regexp.MustCompile(`(initialization|media)="([^"]*)"`)
+)
+
+const (
+	//TokenParam is the query parameter of playback token
+	TokenParam = "token"
+)
+
+//Signer mint and verify the playback tokens of stream, the token is
+//base64 of "{id}|{expire unix}|{ip}" and its hmac-sha256, the empty ip
+//is not bound to client
+type Signer struct {
+	key []byte
+}
+
+func NewSigner(key []byte) (*Signer,error) {
+	if len(key)==0{
+		return nil,fmt.Errorf("token key is empty")
+	}
+	return &Signer{key:key},nil
+}
+
+func (s *Signer) mac(payload []byte) []byte {
+	m := hmac.New(sha256.New,s.key)
+	m.Write(payload)
+	return m.Sum(nil)
+}
+
+//Sign return the token of stream id valid until expire, ip bind the token
+//to client if not empty
+func (s *Signer) Sign(id string,expire time.Time,ip string) string {
+	payload := []byte(fmt.Sprintf("%s|%d|%s",id,expire.Unix(),ip))
+	return base64.RawURLEncoding.EncodeToString(payload)+"."+
+		base64.RawURLEncoding.EncodeToString(s.mac(payload))
+}
+
+//Verify check the token is signed for stream id and client ip, and not expired at now
+func (s *Signer) Verify(token string,id string,ip string,now time.Time) error {
+	parts := strings.Split(token,".")
+	if len(parts)!=2{
+		return ErrTokenInvalid
+	}
+	payload,err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err!= nil{
+		return ErrTokenInvalid
+	}
+	sig,err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err!= nil || !hmac.Equal(sig,s.mac(payload)){
+		return ErrTokenInvalid
+	}
+	//id may contain the separator, so split from the end
+	fields := strings.Split(string(payload),"|")
+	if len(fields)<3{
+		return ErrTokenInvalid
+	}
+	n := len(fields)
+	if strings.Join(fields[:n-2],"|")!=id{
+		return ErrTokenInvalid
+	}
+	expire,err := strconv.ParseInt(fields[n-2],10,64)
+	if err!= nil{
+		return ErrTokenInvalid
+	}
+	if fields[n-1]!="" && fields[n-1]!=ip{
+		return ErrTokenInvalid
+	}
+	if now.Unix()>expire{
+		return ErrTokenExpired
+	}
+	return nil
+}
+
+//ClientIP return the normalized ip of remote address
+func ClientIP(req *http.Request) string {
+	host,_,err := net.SplitHostPort(req.RemoteAddr)
+	if err!= nil{
+		host = req.RemoteAddr
+	}
+	if ip:=net.ParseIP(host);ip!= nil{
+		return ip.String()
+	}
+	return host
+}
+
+func addQuery(uri []byte,query string) []byte {
+	if bytes.IndexByte(uri,'?')>=0{
+		return append(append(uri,'&'),query...)
+	}
+	return append(append(uri,'?'),query...)
+}
+
+func tokenQuery(req *http.Request) string {
+	token := req.URL.Query().Get(TokenParam)
+	if token==""{
+		return ""
+	}
+	return TokenParam+"="+url.QueryEscape(token)
+}
+
+//withToken append the token of request to the uris in playlist
+func withToken(req *http.Request,playlist []byte) []byte {
+	query := tokenQuery(req)
+	if query==""{
+		return playlist
+	}
+	lines := bytes.Split(playlist,[]byte("\n"))
+	for i,line:=range lines{
+		switch {
+		case len(line)==0:
+		case line[0]!='#':
+			lines[i] = addQuery(append([]byte(nil),line...),query)
+		default:
+			lines[i] = uriAttr.ReplaceAllFunc(line, func(attr []byte) []byte {
+				uri := attr[len(`URI="`):len(attr)-1]
+				return append(append([]byte(`URI="`),addQuery(append([]byte(nil),uri...),query)...),'"')
+			})
+		}
+	}
+	return bytes.Join(lines,[]byte("\n"))
+}
+
+//withTokenMpd append the token of request to the segment template in mpd
+func withTokenMpd(req *http.Request,mpd []byte) []byte {
+	query := tokenQuery(req)
+	if query==""{
+		return mpd
+	}
+	return templateAttr.ReplaceAllFunc(mpd, func(attr []byte) []byte {
+		i := bytes.IndexByte(attr,'"')
+		uri := addQuery(append([]byte(nil),attr[i+1:len(attr)-1]...),query)
+		return append(append(append([]byte(nil),attr[:i+1]...),uri...),'"')
+	})
+}
@@ -0,0 +1,68 @@
+package stream
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSigner(t *testing.T) {
+	var (
+		now = time.Unix(1600000000,0)
+	)
+	if _,err:=NewSigner(nil);err==nil{
+		t.Errorf("empty key should fail")
+	}
+	s,_ := NewSigner([]byte("secret"))
+	other,_ := NewSigner([]byte("other"))
+	token := s.Sign("a|b",now.Add(time.Minute),"")
+	bound := s.Sign("a|b",now.Add(time.Minute),"10.0.0.1")
+	tests := []struct{
+		name string
+		token string
+		id string
+		ip string
+		now time.Time
+		want error
+	}{
+		{"valid",token,"a|b","10.0.0.2",now,nil},
+		{"expired",token,"a|b","",now.Add(time.Minute*2),ErrTokenExpired},
+		{"other stream",token,"a","",now,ErrTokenInvalid},
+		{"ip bound",bound,"a|b","10.0.0.1",now,nil},
+		{"other ip",bound,"a|b","10.0.0.2",now,ErrTokenInvalid},
+		{"other key",other.Sign("a|b",now.Add(time.Minute),""),"a|b","",now,ErrTokenInvalid},
+		{"tampered",strings.Replace(token,".","x.",1),"a|b","",now,ErrTokenInvalid},
+		{"malformed","abc","a|b","",now,ErrTokenInvalid},
+	}
+	for _,tt:=range tests{
+		if err:=s.Verify(tt.token,tt.id,tt.ip,tt.now);err!=tt.want{
+			t.Errorf("%s: want %v, got %v",tt.name,tt.want,err)
+		}
+	}
+}
+
+func TestWithToken(t *testing.T) {
+	playlist := "#EXTM3U\n#EXT-X-MAP:URI=\"/live/a/init_0.mp4\"\n" +
+		"#EXT-X-PART:DURATION=0.500,URI=\"/live/a/1_0.m4s\",INDEPENDENT=YES\n" +
+		"#EXTINF:2.000,\n/live/a/0.m4s\n" +
+		"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"/live/a/1_1.m4s?x=1\"\n"
+	req := httptest.NewRequest("GET","/live/a/a.m3u8?token=t.k",nil)
+	got := string(withToken(req,[]byte(playlist)))
+	want := "#EXTM3U\n#EXT-X-MAP:URI=\"/live/a/init_0.mp4?token=t.k\"\n" +
+		"#EXT-X-PART:DURATION=0.500,URI=\"/live/a/1_0.m4s?token=t.k\",INDEPENDENT=YES\n" +
+		"#EXTINF:2.000,\n/live/a/0.m4s?token=t.k\n" +
+		"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"/live/a/1_1.m4s?x=1&token=t.k\"\n"
+	if got!=want{
+		t.Errorf("playlist unexpected:\n%s",got)
+	}
+	if got:=string(withToken(httptest.NewRequest("GET","/live/a/a.m3u8",nil),[]byte(playlist)));got!=playlist{
+		t.Errorf("playlist without token should not change:\n%s",got)
+	}
+
+	mpd := `<SegmentTemplate initialization="$RepresentationID$/init_0.mp4" media="$RepresentationID$/$Number$.m4s">`
+	got = string(withTokenMpd(req,[]byte(mpd)))
+	if got!=`<SegmentTemplate initialization="$RepresentationID$/init_0.mp4?token=t.k" media="$RepresentationID$/$Number$.m4s?token=t.k">`{
+		t.Errorf("mpd unexpected %s",got)
+	}
+}
@@ -0,0 +1,430 @@
+package stream
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nareix/joy4/format/mp4"
+	"github.com/nareix/joy4/format/mp4/mp4io"
+	"github.com/nareix/joy4/format/ts"
+)
+
+//vodTarget is the max duration of segments in vod playlist, the files are
+//split at key frames or fragments, a segment is longer only if its gop is
+const vodTarget = time.Second*10
+
+//Vod serve the recordings in dir, routes are
+//{prefix}/{id}/index.m3u8?from={time}&to={time}, {prefix}/{id}/{name}.mp4
+//and {prefix}/{id}/{name}_{start}_{end}.ts which is remuxed from the mp4 file
+//in the time range of milliseconds
+type Vod struct {
+	c *Catalog
+	prefix string
+}
+
+func NewVod(c *Catalog,preroute string) *Vod {
+	return &Vod{
+		c:c,
+		prefix:preroute,
+	}
+}
+
+//Path return the url of the mp4 file
+func (v *Vod) Path(r *Record) string {
+	return path.Join(v.prefix,r.Id,r.Name)
+}
+
+func (v *Vod) HandlerStream(w http.ResponseWriter,req *http.Request) {
+	var (
+		r = strings.TrimPrefix(path.Clean(req.URL.Path),v.prefix)
+		names = strings.Split(strings.Trim(r,"/"),"/")
+	)
+	if len(names)!=2{
+		http.NotFound(w,req)
+		return
+	}
+	id,name := names[0],names[1]
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	switch path.Ext(name) {
+	case ".m3u8":
+		v.serveM3u8(w,req,id)
+	case ".mp4":
+		v.serveMp4(w,req,id,name)
+	case ".ts":
+		v.serveTs(w,req,id,name)
+	default:
+		http.NotFound(w,req)
+	}
+}
+
+//open the recording file, name must be {id}-{unix}.mp4
+func (v *Vod) open(id string,name string) (*os.File,error) {
+	if sid,_,_:=splitname(name);sid=="" || sid!=id || name!=path.Base(name){
+		return nil,ErrNameIncorrect
+	}
+	return os.Open(filepath.Join(v.c.Dir(),name))
+}
+
+func (v *Vod) serveMp4(w http.ResponseWriter,req *http.Request,id string,name string) {
+	f,err := v.open(id,name)
+	if err!= nil{
+		http.NotFound(w,req)
+		return
+	}
+	defer f.Close()
+	info,err := f.Stat()
+	if err!= nil{
+		http.Error(w,err.Error(),http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp4")
+	http.ServeContent(w,req,name,info.ModTime(),f)
+}
+
+//serveTs remux the time range of {name}_{start}_{end}.ts from the mp4 file,
+//the segment is buffered so it has length and range
+func (v *Vod) serveTs(w http.ResponseWriter,req *http.Request,id string,name string) {
+	var (
+		fields = strings.Split(strings.TrimSuffix(name,".ts"),"_")
+		n = len(fields)
+	)
+	if n<3{
+		http.NotFound(w,req)
+		return
+	}
+	start,err1 := strconv.ParseInt(fields[n-2],10,64)
+	end,err2 := strconv.ParseInt(fields[n-1],10,64)
+	if err1!= nil || err2!= nil || start<0 || end<=start{
+		http.NotFound(w,req)
+		return
+	}
+	f,err := v.open(id,strings.Join(fields[:n-2],"_")+".mp4")
+	if err!= nil{
+		http.NotFound(w,req)
+		return
+	}
+	defer f.Close()
+	info,err := f.Stat()
+	if err!= nil{
+		http.Error(w,err.Error(),http.StatusInternalServerError)
+		return
+	}
+	bs,err := remuxTs(f,time.Duration(start)*time.Millisecond,time.Duration(end)*time.Millisecond)
+	if err!= nil{
+		fmt.Println("vod","file",name,"remux failed",err)
+		http.Error(w,err.Error(),http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp2ts")
+	http.ServeContent(w,req,name,info.ModTime(),bytes.NewReader(bs))
+}
+
+//remuxTs mux the packets in [start,end) of mp4 into ts, start is a key frame
+//rounded up to millisecond, and so is end
+func remuxTs(f *os.File,start,end time.Duration) ([]byte,error) {
+	var (
+		buf bytes.Buffer
+		demux = mp4.NewDemuxer(f)
+		mux = ts.NewMuxer(&buf)
+	)
+	cds,err := demux.Streams()
+	if err!= nil{
+		return nil,err
+	}
+	if err = mux.WriteHeader(cds);err!= nil{
+		return nil,err
+	}
+	//the demuxer seek to the key frame before start if start is a key frame,
+	//so the packets before start are skipped
+	if err = demux.SeekToTime(start);err!= nil{
+		return nil,err
+	}
+	for {
+		pkt,err := demux.ReadPacket()
+		if err!= nil{
+			break
+		}
+		if pkt.Time+time.Millisecond<=start{
+			continue
+		}
+		if pkt.Time+time.Millisecond>end{
+			break
+		}
+		if err = mux.WritePacket(pkt);err!= nil{
+			return nil,err
+		}
+	}
+	if err = mux.WriteTrailer();err!= nil{
+		return nil,err
+	}
+	return buf.Bytes(),nil
+}
+
+func (v *Vod) serveM3u8(w http.ResponseWriter,req *http.Request,id string) {
+	var (
+		query = req.URL.Query()
+		from,to time.Time
+		err error
+	)
+	if s:=query.Get("from");s!=""{
+		if from,err = ParseTime(s);err!= nil{
+			http.Error(w,err.Error(),http.StatusBadRequest)
+			return
+		}
+	}
+	if s:=query.Get("to");s!=""{
+		if to,err = ParseTime(s);err!= nil{
+			http.Error(w,err.Error(),http.StatusBadRequest)
+			return
+		}
+	}
+	records := RecordsIn(v.c.Query(id,from,to),from,to)
+	if len(records)==0{
+		http.NotFound(w,req)
+		return
+	}
+	bs := withToken(req,v.M3u8(records))
+	w.Header().Set("Content-Type", "application/x-mpegURL")
+	w.Header().Set("Content-Length", strconv.Itoa(len(bs)))
+	w.Write(bs)
+}
+
+//RecordsIn return the completed continuous recordings overlapping [from,to),
+//zero time is unbounded
+func RecordsIn(records []*Record,from,to time.Time) []*Record {
+	var (
+		in []*Record
+	)
+	for _,r:=range records{
+		if r.Duration<=0 || r.Event!=""{
+			continue
+		}
+		if !from.IsZero() && !r.End().After(from){
+			continue
+		}
+		if !to.IsZero() && !r.Start.Before(to){
+			continue
+		}
+		in = append(in,r)
+	}
+	return in
+}
+
+//M3u8 stitch the recordings into VOD playlist, the files are split into
+//segments of vodTarget, the timestamps restart in every file, so files are
+//split by discontinuity. Fragmented mp4 is served by byte range of the file,
+//and mp4 is remuxed to ts by time range
+func (v *Vod) M3u8(records []*Record) []byte {
+	var (
+		buf bytes.Buffer
+		target float64
+		version = 4
+		segs = make([][]vodSeg,len(records))
+		err error
+	)
+	for i,r:=range records{
+		if segs[i],err = vodSegments(r);err!= nil{
+			fmt.Println("vod","file",r.Path,"split failed",err)
+			continue
+		}
+		for _,seg:=range segs[i]{
+			target = math.Max(target,(seg.end-seg.start).Seconds())
+		}
+		if r.InitSize>0{
+			version = 7
+		}
+	}
+	buf.WriteString(fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:%d\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n\n",
+		version,int(math.Ceil(target))))
+	first := true
+	for i,r:=range records{
+		if len(segs[i])==0{
+			continue
+		}
+		if !first{
+			buf.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		first = false
+		base := strings.TrimSuffix(r.Name,".mp4")
+		if r.InitSize>0{
+			buf.WriteString(fmt.Sprintf("#EXT-X-MAP:URI=\"%s\",BYTERANGE=\"%d@0\"\n",v.Path(r),r.InitSize))
+		}
+		buf.WriteString(fmt.Sprintf("#EXT-X-PROGRAM-DATE-TIME:%s\n",r.Start.Add(segs[i][0].start).UTC().Format(mpdTimeLayout)))
+		for _,seg:=range segs[i]{
+			buf.WriteString(fmt.Sprintf("#EXTINF:%0.3f,\n",(seg.end-seg.start).Seconds()))
+			if r.InitSize>0{
+				buf.WriteString(fmt.Sprintf("#EXT-X-BYTERANGE:%d@%d\n%s\n",seg.size,seg.off,v.Path(r)))
+				continue
+			}
+			buf.WriteString(path.Join(v.prefix,r.Id,fmt.Sprintf("%s_%d_%d.ts",base,ceilMs(seg.start),ceilMs(seg.end)))+"\n")
+		}
+	}
+	buf.WriteString("#EXT-X-ENDLIST\n")
+	return buf.Bytes()
+}
+
+//vodSeg is a segment of recording, off and size is the byte range of the
+//fragments of fragmented mp4
+type vodSeg struct {
+	start,end time.Duration
+	off,size int64
+}
+
+func ceilMs(d time.Duration) int64 {
+	return int64((d+time.Millisecond-1)/time.Millisecond)
+}
+
+//vodSegments split the recording into segments not longer than vodTarget,
+//the fragmented mp4 is split at fragments and mp4 at key frames
+func vodSegments(r *Record) ([]vodSeg,error) {
+	f,err := os.Open(r.Path)
+	if err!= nil{
+		return nil,err
+	}
+	defer f.Close()
+	atoms,err := mp4io.ReadFileAtoms(f)
+	if err!= nil && len(atoms)==0{
+		return nil,err
+	}
+	var (
+		moov *mp4io.Movie
+	)
+	for _,atom:=range atoms{
+		if v,ok:=atom.(*mp4io.Movie);ok{
+			moov = v
+			break
+		}
+	}
+	if moov==nil || len(moov.Tracks)==0{
+		return nil,fmt.Errorf("%s has no moov",r.Path)
+	}
+	if r.InitSize>0{
+		return fragSegments(f,atoms,moov.Tracks[0],r.Size),nil
+	}
+	return keySegments(moov)
+}
+
+//fragSegments group the complete fragments within size into segments
+func fragSegments(f *os.File,atoms []mp4io.Atom,track *mp4io.Track,size int64) []vodSeg {
+	var (
+		segs []vodSeg
+		cur vodSeg
+		//frag is the fragment whose mdat is not read
+		frag *vodSeg
+		trackid = uint32(track.Header.TrackId)
+		timescale = int64(track.Media.Header.TimeScale)
+		at time.Duration
+	)
+	if timescale<=0{
+		return nil
+	}
+	for _,atom:=range atoms{
+		switch v:=atom.(type) {
+		case *mp4io.MovieFrag:
+			off,_ := v.Pos()
+			dur := time.Duration(fragDuration(f,v,trackid))*time.Second/time.Duration(timescale)
+			frag = &vodSeg{start:at,end:at+dur,off:int64(off)}
+		case *mp4io.Dummy:
+			off,n := v.Pos()
+			if v.Tag()!=mp4io.MDAT || frag==nil || int64(off+n)>size{
+				continue
+			}
+			frag.size = int64(off+n)-frag.off
+			at = frag.end
+			if cur.size>0 && frag.end-cur.start>vodTarget{
+				segs = append(segs,cur)
+				cur = vodSeg{}
+			}
+			if cur.size==0{
+				cur = *frag
+			}else{
+				cur.end,cur.size = frag.end,frag.off+frag.size-cur.off
+			}
+			frag = nil
+		}
+	}
+	if cur.size>0{
+		segs = append(segs,cur)
+	}
+	return segs
+}
+
+//keySegments cut the mp4 at the key frames of video, the last key frame
+//within vodTarget of the segment start
+func keySegments(moov *mp4io.Movie) ([]vodSeg,error) {
+	var (
+		track = moov.Tracks[0]
+		keys []time.Duration
+		total time.Duration
+		segs []vodSeg
+	)
+	for _,trak:=range moov.Tracks{
+		if trak.Media!= nil && trak.Media.Info!= nil && trak.Media.Info.Sample!= nil &&
+			trak.Media.Info.Sample.SampleDesc!= nil && trak.Media.Info.Sample.SampleDesc.AVC1Desc!= nil{
+			track = trak
+			break
+		}
+	}
+	if track.Media==nil || track.Media.Header==nil || track.Media.Header.TimeScale<=0 ||
+		track.Media.Info==nil || track.Media.Info.Sample==nil || track.Media.Info.Sample.TimeToSample==nil{
+		return nil,fmt.Errorf("invalid track")
+	}
+	var (
+		sample = track.Media.Info.Sample
+		timescale = int64(track.Media.Header.TimeScale)
+		sync = make(map[uint32]bool)
+		n uint32
+		ts int64
+	)
+	if sample.SyncSample!= nil{
+		for _,i:=range sample.SyncSample.Entries{
+			sync[i] = true
+		}
+	}
+	for _,e:=range sample.TimeToSample.Entries{
+		for i:=uint32(0);i<e.Count;i++{
+			//sync sample numbers start from 1, all are sync if no stss
+			n++
+			if sample.SyncSample==nil || sync[n]{
+				keys = append(keys,time.Duration(ts)*time.Second/time.Duration(timescale))
+			}
+			ts += int64(e.Duration)
+		}
+	}
+	total = time.Duration(ts)*time.Second/time.Duration(timescale)
+	if len(keys)==0 || total<=0{
+		return nil,fmt.Errorf("no key frame")
+	}
+	var (
+		start = keys[0]
+		last = start
+	)
+	for _,k:=range append(keys[1:],total){
+		if k-start>vodTarget && last>start{
+			segs = append(segs,vodSeg{start:start,end:last})
+			start = last
+		}
+		last = k
+	}
+	return append(segs,vodSeg{start:start,end:total}),nil
+}
+
+//ParseTime accept unix seconds or RFC3339
+func ParseTime(s string) (time.Time,error) {
+	if sec,err:=strconv.ParseInt(s,10,64);err==nil{
+		return time.Unix(sec,0),nil
+	}
+	t,err := time.Parse(time.RFC3339,s)
+	if err!= nil{
+		return t,fmt.Errorf("invalid time %s, should be unix seconds or RFC3339",s)
+	}
+	return t,nil
+}
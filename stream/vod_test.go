@@ -0,0 +1,202 @@
+package stream
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/nareix/joy4/format/mp4"
+	"github.com/nareix/joy4/format/ts"
+)
+
+//writeTestMp4 write n seconds of 25fps video into {dir}/{id}-{start}.mp4
+func writeTestMp4(t *testing.T,dir string,id string,start int64,n int) {
+	writeTestFile(t,dir,id,start,n,false)
+}
+
+//writeTestFile write n seconds of 25fps video with a key frame every second,
+//the file is fragmented mp4 if frag
+func writeTestFile(t *testing.T,dir string,id string,start int64,n int,frag bool) {
+	f,err := os.Create(filepath.Join(dir,fmt.Sprintf("%s-%d.mp4",id,start)))
+	if err!= nil{
+		t.Fatal(err)
+	}
+	defer f.Close()
+	cd,err := h264parser.NewCodecDataFromSPSAndPPS(testsps,testpps)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	var mux av.Muxer = mp4.NewMuxer(f)
+	if frag{
+		mux = newFmp4FileMuxer(f,recordFragtime)
+	}
+	if err = mux.WriteHeader([]av.CodecData{cd});err!= nil{
+		t.Fatal(err)
+	}
+	for i:=0;i<n*25;i++{
+		err = mux.WritePacket(av.Packet{
+			IsKeyFrame:i%25==0,
+			Time:time.Duration(i)*time.Second/25,
+			Data:[]byte{0,0,0,2,0x65,0x88},
+		})
+		if err!= nil{
+			t.Fatal(err)
+		}
+	}
+	if err = mux.WriteTrailer();err!= nil{
+		t.Fatal(err)
+	}
+}
+
+func TestVod(t *testing.T) {
+	dir,err := ioutil.TempDir("","vod")
+	if err!= nil{
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestMp4(t,dir,"test",1000,10)
+	writeTestMp4(t,dir,"test",1010,10)
+	writeTestMp4(t,dir,"test",1020,25)
+	writeTestMp4(t,dir,"other",1000,10)
+	//the file in writing has no moov
+	ioutil.WriteFile(filepath.Join(dir,"test-1030.mp4"),[]byte{0,0,0,8,'m','d','a','t'},0644)
+
+	c,err := OpenCatalog(dir)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	v := NewVod(c,"/vod")
+	records := c.Query("test",time.Time{},time.Time{})
+	if len(records)!=4 || records[0].Name!="test-1000.mp4" || records[0].Duration<time.Second*9 || records[3].Duration!=0{
+		t.Fatalf("unexpected records %+v",records)
+	}
+	if in:=RecordsIn(records,time.Unix(1015,0),time.Unix(1040,0));len(in)!=2 || in[0].Name!="test-1010.mp4"{
+		t.Errorf("records in range should be 1010 and 1020, got %d",len(in))
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(v.HandlerStream))
+	defer srv.Close()
+
+	resp,err := http.Get(srv.URL+"/vod/test/index.m3u8?from=1005&to=2021-01-01T00:00:00Z")
+	if err!= nil{
+		t.Fatal(err)
+	}
+	bs,_ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	m3u8 := string(bs)
+	for _,want:=range []string{
+		"#EXT-X-PLAYLIST-TYPE:VOD",
+		"#EXT-X-TARGETDURATION:10\n",
+		"#EXTINF:9.960,\n/vod/test/test-1000_0_9960.ts",
+		"#EXT-X-DISCONTINUITY\n",
+		//the long file is split at key frames
+		"#EXTINF:10.000,\n/vod/test/test-1020_0_10000.ts",
+		"#EXTINF:10.000,\n/vod/test/test-1020_10000_20000.ts",
+		"#EXTINF:4.960,\n/vod/test/test-1020_20000_24960.ts",
+		"#EXT-X-ENDLIST",
+	}{
+		if !strings.Contains(m3u8,want){
+			t.Errorf("playlist miss %s:\n%s",want,m3u8)
+		}
+	}
+	if strings.Contains(m3u8,"test-1030"){
+		t.Errorf("file in writing should not be listed:\n%s",m3u8)
+	}
+
+	req,_ := http.NewRequest(http.MethodGet,srv.URL+"/vod/test/test-1000.mp4",nil)
+	req.Header.Set("Range","bytes=0-99")
+	resp,err = http.DefaultClient.Do(req)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode!=http.StatusPartialContent || resp.ContentLength!=100{
+		t.Errorf("range request should be 206 with 100 bytes, got %d %d",resp.StatusCode,resp.ContentLength)
+	}
+
+	resp,err = http.Get(srv.URL+"/vod/test/test-1020_10000_20000.ts")
+	if err!= nil{
+		t.Fatal(err)
+	}
+	bs,_ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if len(bs)==0 || len(bs)%188!=0 || resp.ContentLength!=int64(len(bs)){
+		t.Errorf("remuxed ts invalid, len %d content length %d",len(bs),resp.ContentLength)
+	}
+	demux := ts.NewDemuxer(bytes.NewReader(bs))
+	var pkts []av.Packet
+	for {
+		pkt,err := demux.ReadPacket()
+		if err!= nil{
+			break
+		}
+		pkts = append(pkts,pkt)
+	}
+	//the ts muxer delay timestamps by 1s
+	if len(pkts)!=250 || !pkts[0].IsKeyFrame || pkts[0].Time!=time.Second*11{
+		t.Fatalf("segment should have 250 packets from 10s, got %d",len(pkts))
+	}
+
+	for _,name:=range []string{"/vod/test/other-1000.mp4","/vod/test/..%2Fx.mp4"}{
+		resp,err = http.Get(srv.URL+name)
+		if err!= nil{
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode!=http.StatusNotFound{
+			t.Errorf("%s should be 404, got %d",name,resp.StatusCode)
+		}
+	}
+}
+
+func TestVodFmp4(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t,dir,"test",1000,25,true)
+	c,err := OpenCatalog(dir)
+	if err!= nil{
+		t.Fatal(err)
+	}
+	v := NewVod(c,"/vod")
+	records := c.Query("test",time.Time{},time.Time{})
+	if len(records)!=1 || records[0].InitSize==0{
+		t.Fatalf("unexpected records %+v",records)
+	}
+	r := records[0]
+	m3u8 := string(v.M3u8(records))
+	for _,want:=range []string{
+		"#EXT-X-VERSION:7",
+		"#EXT-X-TARGETDURATION:10\n",
+		fmt.Sprintf("#EXT-X-MAP:URI=\"/vod/test/test-1000.mp4\",BYTERANGE=\"%d@0\"",r.InitSize),
+		"#EXTINF:10.000,\n#EXT-X-BYTERANGE:",
+		"#EXTINF:5.000,\n#EXT-X-BYTERANGE:",
+	}{
+		if !strings.Contains(m3u8,want){
+			t.Errorf("playlist miss %s:\n%s",want,m3u8)
+		}
+	}
+	//the byte ranges cover the fragments of file without gap
+	ranges := regexp.MustCompile(`#EXT-X-BYTERANGE:(\d+)@(\d+)`).FindAllStringSubmatch(m3u8,-1)
+	next := r.InitSize
+	for _,m:=range ranges{
+		size,_ := strconv.ParseInt(m[1],10,64)
+		off,_ := strconv.ParseInt(m[2],10,64)
+		if off!=next{
+			t.Errorf("byte range at %d, want %d",off,next)
+		}
+		next = off+size
+	}
+	if len(ranges)!=3 || next!=r.Size{
+		t.Errorf("want 3 segments to %d, got %d to %d:\n%s",r.Size,len(ranges),next,m3u8)
+	}
+}
@@ -0,0 +1,225 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+const (
+	HookConnect = "source.connected"
+	HookDisconnect = "source.disconnected"
+	//HookDown is fired when the source is not connected for WebhookConf.Down
+	HookDown = "source.down"
+	HookRecord = "recording.finalized"
+	HookDelete = "recording.deleted"
+	HookAdd = "stream.added"
+	HookRemove = "stream.removed"
+
+	webhookQueueSize = 256
+	//webhookDrain is the max time sending the queued events when stop
+	webhookDrain = time.Second * 5
+)
+
+//HookEvent is the payload of webhook
+type HookEvent struct {
+	Type string `json:"type"`
+	Stream string `json:"stream"`
+	Url string `json:"url,omitempty"`
+	At time.Time `json:"at"`
+	Error string `json:"error,omitempty"`
+	//Down is the seconds since the source disconnected
+	Down float64 `json:"down,omitempty"`
+	//OnDemand is set when the stream added is pulled by viewers only, it is
+	//not dialed until then, so it is not watched for HookDown until it dial
+	OnDemand bool `json:"on_demand,omitempty"`
+	Record *Record `json:"recording,omitempty"`
+}
+
+//Hooker receive the lifecycle events of streams and recordings, it must not block
+type Hooker interface {
+	Hook(ev *HookEvent)
+}
+
+type WebhookConf struct {
+	Urls []string
+	//Timeout is the timeout of one request
+	Timeout time.Duration
+	//Retry is the max time retrying one event, 0 is retry once
+	Retry time.Duration
+	//Down fire HookDown when the source is not connected that long, 0 is disabled
+	Down time.Duration
+}
+
+//Webhook post the events to every url in order, the url failed is retried
+//with exponential backoff, and the events are dropped when the queue is full
+type Webhook struct {
+	c *WebhookConf
+	cli *http.Client
+	mu sync.Mutex
+	queues []chan *HookEvent
+	downs map[string]*time.Timer
+	stopped bool
+	ctx context.Context
+	cancel context.CancelFunc
+	wg sync.WaitGroup
+}
+
+func NewWebhook(c *WebhookConf) *Webhook {
+	ctx,cancel := context.WithCancel(context.Background())
+	w := &Webhook{
+		c:c,
+		cli:&http.Client{Timeout:c.Timeout},
+		downs:make(map[string]*time.Timer),
+		ctx:ctx,
+		cancel:cancel,
+	}
+	for _,u:=range c.Urls{
+		ch := make(chan *HookEvent,webhookQueueSize)
+		w.queues = append(w.queues,ch)
+		w.wg.Add(1)
+		go func(u string) {
+			defer w.wg.Done()
+			for ev:=range ch{
+				if err:=w.post(u,ev);err!= nil{
+					fmt.Println("module","webhook","url",u,"event",ev.Type,"stream",ev.Stream,"failed",err)
+				}
+			}
+		}(u)
+	}
+	return w
+}
+
+//Hook queue the event, and track the source down
+func (w *Webhook) Hook(ev *HookEvent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopped{
+		return
+	}
+	switch ev.Type {
+	case HookAdd:
+		if !ev.OnDemand{
+			w.watch(ev)
+		}
+	case HookDisconnect:
+		w.watch(ev)
+	case HookConnect,HookRemove:
+		if t,ok:=w.downs[ev.Stream];ok{
+			t.Stop()
+			delete(w.downs,ev.Stream)
+		}
+	}
+	w.send(ev)
+}
+
+//send must be called with w.mu held
+func (w *Webhook) send(ev *HookEvent) {
+	for i,ch:=range w.queues{
+		select {
+		case ch<-ev:
+		default:
+			fmt.Println("module","webhook","url",w.c.Urls[i],"queue full, drop event",ev.Type,"stream",ev.Stream)
+		}
+	}
+}
+
+//watch start the down timer of stream if not yet, must be called with w.mu held
+func (w *Webhook) watch(ev *HookEvent) {
+	if w.c.Down<=0{
+		return
+	}
+	if _,ok:=w.downs[ev.Stream];ok{
+		return
+	}
+	var (
+		since = ev.At
+		id,u = ev.Stream,ev.Url
+		t *time.Timer
+	)
+	//the timer is replaced if the source reconnect and disconnect again
+	t = time.AfterFunc(w.c.Down, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if w.stopped || w.downs[id]!=t{
+			return
+		}
+		delete(w.downs,id)
+		now := time.Now()
+		w.send(&HookEvent{
+			Type:HookDown,
+			Stream:id,
+			Url:u,
+			At:now,
+			Down:now.Sub(since).Seconds(),
+		})
+	})
+	w.downs[id] = t
+}
+
+func (w *Webhook) post(u string,ev *HookEvent) error {
+	bs,err := json.Marshal(ev)
+	if err!= nil{
+		return err
+	}
+	bk := backoff.NewExponentialBackOff()
+	bk.MaxElapsedTime = w.c.Retry
+	var b backoff.BackOff = bk
+	if w.c.Retry<=0{
+		b = backoff.WithMaxRetries(&backoff.ZeroBackOff{},1)
+	}
+	return backoff.Retry(func() error {
+		req,err := http.NewRequestWithContext(w.ctx,http.MethodPost,u,bytes.NewReader(bs))
+		if err!= nil{
+			return backoff.Permanent(err)
+		}
+		req.Header.Set("Content-Type","application/json")
+		resp,err := w.cli.Do(req)
+		if err!= nil{
+			return err
+		}
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode<300:
+			return nil
+		case resp.StatusCode<500 && resp.StatusCode!=http.StatusTooManyRequests:
+			return backoff.Permanent(fmt.Errorf("status %s",resp.Status))
+		}
+		return fmt.Errorf("status %s",resp.Status)
+	},backoff.WithContext(b,w.ctx))
+}
+
+//Stop send the queued events in webhookDrain, the rest are dropped
+func (w *Webhook) Stop() {
+	w.mu.Lock()
+	if w.stopped{
+		w.mu.Unlock()
+		return
+	}
+	w.stopped = true
+	for id,t:=range w.downs{
+		t.Stop()
+		delete(w.downs,id)
+	}
+	for _,ch:=range w.queues{
+		close(ch)
+	}
+	w.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(webhookDrain):
+	}
+	w.cancel()
+	<-done
+}
@@ -0,0 +1,70 @@
+package stream
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhook(t *testing.T) {
+	var (
+		mu sync.Mutex
+		calls int
+		got []*HookEvent
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		//the first request fail and is retried
+		if calls==1{
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		ev := &HookEvent{}
+		if err:=json.NewDecoder(req.Body).Decode(ev);err!= nil{
+			t.Errorf("decode payload failed %v",err)
+		}
+		got = append(got,ev)
+	}))
+	defer srv.Close()
+
+	w := NewWebhook(&WebhookConf{
+		Urls:[]string{srv.URL},
+		Timeout:time.Second,
+		Retry:time.Second*5,
+		Down:time.Millisecond*200,
+	})
+	now := time.Now()
+	w.Hook(&HookEvent{Type:HookAdd,Stream:"a",At:now})
+	w.Hook(&HookEvent{Type:HookConnect,Stream:"a",At:now})
+	w.Hook(&HookEvent{Type:HookAdd,Stream:"b",At:now})
+	//c is not dialed until viewed, so it is not down
+	w.Hook(&HookEvent{Type:HookAdd,Stream:"c",At:now,OnDemand:true})
+	w.Hook(&HookEvent{Type:HookRecord,Stream:"a",At:now,Record:&Record{Id:"a",Name:"a_1.mp4"}})
+	//b never connect, so it is down
+	time.Sleep(time.Millisecond*600)
+	w.Stop()
+	w.Hook(&HookEvent{Type:HookRemove,Stream:"a",At:now})
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{HookAdd,HookConnect,HookAdd,HookAdd,HookRecord,HookDown}
+	if len(got)!=len(want){
+		t.Fatalf("want %d events, got %d",len(want),len(got))
+	}
+	for i,ev:=range got{
+		if ev.Type!=want[i]{
+			t.Errorf("event %d want %s, got %s",i,want[i],ev.Type)
+		}
+	}
+	if got[4].Record==nil || got[4].Record.Name!="a_1.mp4"{
+		t.Errorf("recording not in payload %+v",got[4])
+	}
+	if got[5].Stream!="b" || got[5].Down<0.2{
+		t.Errorf("down event unexpected %+v",got[5])
+	}
+}